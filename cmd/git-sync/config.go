@@ -0,0 +1,506 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clbiggs/git-sync/internal/configfile"
+	"github.com/clbiggs/git-sync/pkg/git/syncer"
+)
+
+type Configuration struct {
+	// Name is the repo addressed by the top level /status and /webhook apis.
+	Name                string
+	EnableWebhook       bool
+	WebhookUsername     string
+	WebhookPassword     string
+	WebhookPasswordFile string
+	ServerAddr          string
+	MaxConcurrentSyncs  int
+	ShutdownTimeout     time.Duration
+	DegradedStartup     bool
+	Repos               []configfile.Repo
+}
+
+// flagValues holds the command line flags. Each flag defaults to its
+// environment variable and then to its default value.
+type flagValues struct {
+	ConfigFile          string
+	ConfigCheckInterval time.Duration
+	Name                string
+	Repo                string
+	Path                string
+	Branch              string
+	Ref                 string
+	IncludePrerelease   bool
+	CABuntleFile        string
+	PollInterval        time.Duration
+	Username            string
+	Password            string
+	PasswordFile        string
+	SSHPrivateKeyFile   string
+	InsecureSkipTLS     bool
+	KnownHostsFile      string
+	PublishRoot         string
+	KeepRevisions       int
+	PreSyncHook         string
+	PostSyncHook        string
+	HookTimeout         time.Duration
+	NotifyURL           string
+	NotifySecret        string
+	NotifyEvents        string
+	CloneTimeout        time.Duration
+	FetchTimeout        time.Duration
+	CheckoutTimeout     time.Duration
+	RetryBackoff        time.Duration
+	RetryMaxBackoff     time.Duration
+	PollJitter          float64
+	AuthFailures        int
+	CircuitOpenDuration time.Duration
+	QuarantineDir       string
+	QuarantineKeep      int
+	StateFile           string
+	HistoryLimit        int
+	PersistHistory      bool
+	Depth               int
+	Filter              string
+	SparseInclude       string
+	SparseExclude       string
+	Submodules          bool
+	SubmoduleMaxDepth   int
+	SubmoduleURLs       string
+	LFS                 bool
+	LFSURL              string
+	LFSInclude          string
+	LFSExclude          string
+	LFSCacheDir         string
+	EnableWebhook       bool
+	WebhookUsername     string
+	WebhookPassword     string
+	WebhookPasswordFile string
+	ServerAddr          string
+	MaxConcurrentSyncs  int
+	ShutdownTimeout     time.Duration
+	DegradedStartup     bool
+}
+
+var (
+	flags flagValues
+	// flagEnvs maps each flag name to its environment variable.
+	flagEnvs = map[string]string{}
+)
+
+// repoFlags are the flags that configure the repo addressed by --name.
+var repoFlags = []string{
+	"repo", "path", "branch", "ref", "include-prerelease", "ca-bundle-file", "interval", "username", "password",
+	"password-file", "ssh-key-file", "insecure", "known-hosts-file", "publish-root", "keep-revisions",
+	"pre-sync-hook", "post-sync-hook", "hook-timeout", "notify-url", "notify-secret", "notify-events",
+	"clone-timeout", "fetch-timeout", "checkout-timeout", "retry-backoff", "retry-max-backoff", "poll-jitter",
+	"auth-failure-threshold", "circuit-open-duration", "quarantine-dir", "quarantine-keep", "state-file",
+	"history-limit", "persist-history", "depth", "filter", "sparse-include", "sparse-exclude",
+	"submodules", "submodule-max-depth", "submodule-allowed-urls",
+	"lfs", "lfs-url", "lfs-include", "lfs-exclude", "lfs-cache-dir",
+}
+
+func loadFlags() {
+	stringFlag(&flags.ConfigFile, "config", "CONFIG_FILE", "", "Path to a YAML configuration file. Flags and environment variables override its values.")
+	durationFlag(&flags.ConfigCheckInterval, "config-check-interval", "CONFIG_CHECK_INTERVAL", DefaultConfigCheckInterval*time.Second, "How often the configuration file is checked for changes. 0 disables the check")
+	stringFlag(&flags.Name, "name", "REPO_NAME", DefaultRepoName, "Name used to address the repo in the http api")
+	stringFlag(&flags.Repo, "repo", "GIT_REPO", "", "Git repo URL")
+	stringFlag(&flags.Path, "path", "TARGET_PATH", "", "Local repo path")
+	stringFlag(&flags.Branch, "branch", "BRANCH", configfile.DefaultBranch, "Branch to track. The <ref> argument takes precident over this.")
+	stringFlag(&flags.Ref, "ref", "REF_NAME", "", "Reference name. Use the refs/heads/main or refs/tags/v1.0.0 format, or semver:<constraint> to track the highest matching tag.")
+	boolFlag(&flags.IncludePrerelease, "include-prerelease", "INCLUDE_PRERELEASE", false, "Let a semver reference match pre-release tags")
+	stringFlag(&flags.CABuntleFile, "ca-bundle-file", "CA_BUNDLE", "", "CA Certificate bundle file path")
+	durationFlag(&flags.PollInterval, "interval", "POLL_INTERVAL", DefaultInterval*time.Second, "Polling interval")
+	stringFlag(&flags.Username, "username", "GIT_USERNAME", "", "Git username/token")
+	stringFlag(&flags.Password, "password", "GIT_PASSWORD", "", "Git password/token")
+	stringFlag(&flags.PasswordFile, "password-file", "GIT_PASSWORD_FILE", "", "Path to file containing Git password/token")
+	stringFlag(&flags.SSHPrivateKeyFile, "ssh-key-file", "GIT_SSHKEY_FILE", "", "Path to file containing Git SSH Private key")
+	boolFlag(&flags.InsecureSkipTLS, "insecure", "INSECURE_TLS", false, "Use insecure TLS connection")
+	stringFlag(&flags.KnownHostsFile, "known-hosts-file", "KNOWN_HOSTS_FILE", "", "Path to file containing known hosts")
+	stringFlag(&flags.PublishRoot, "publish-root", "PUBLISH_ROOT", "", "Directory each revision is checked out into. When set <path> becomes a symlink to the current revision")
+	intFlag(&flags.KeepRevisions, "keep-revisions", "KEEP_REVISIONS", syncer.DefaultKeepRevisions, "Number of revisions kept in the publish root")
+	stringFlag(&flags.PreSyncHook, "pre-sync-hook", "PRE_SYNC_HOOK", "", "Shell command run before the synced commit changes. A failure aborts the update")
+	stringFlag(&flags.PostSyncHook, "post-sync-hook", "POST_SYNC_HOOK", "", "Shell command run after the synced commit changed")
+	durationFlag(&flags.HookTimeout, "hook-timeout", "HOOK_TIMEOUT", syncer.DefaultHookTimeout, "Timeout of the pre- and post-sync hooks")
+	stringFlag(&flags.NotifyURL, "notify-url", "NOTIFY_URL", "", "URL that receives a POST for sync events")
+	stringFlag(&flags.NotifySecret, "notify-secret", "NOTIFY_SECRET", "", "Secret used to sign the notifications with HMAC-SHA256")
+	stringFlag(&flags.NotifyEvents, "notify-events", "NOTIFY_EVENTS", "", "Comma separated events to notify. Default: all events")
+	durationFlag(&flags.CloneTimeout, "clone-timeout", "CLONE_TIMEOUT", 0, "Timeout of the initial clone. 0 means no timeout")
+	durationFlag(&flags.FetchTimeout, "fetch-timeout", "FETCH_TIMEOUT", 0, "Timeout of a fetch. 0 means no timeout")
+	durationFlag(&flags.CheckoutTimeout, "checkout-timeout", "CHECKOUT_TIMEOUT", 0, "Timeout of the pull or checkout of the synced commit. 0 means no timeout")
+	durationFlag(&flags.RetryBackoff, "retry-backoff", "RETRY_BACKOFF", syncer.DefaultRetryInitialBackoff, "Delay before retrying a sync that failed with a network error or timeout, doubled after each failure")
+	durationFlag(&flags.RetryMaxBackoff, "retry-max-backoff", "RETRY_MAX_BACKOFF", 0, "Maximum delay between retries. 0 means the polling interval")
+	floatFlag(&flags.PollJitter, "poll-jitter", "POLL_JITTER", syncer.DefaultRetryJitter, "Fraction of the polling interval randomly added or subtracted. A negative value disables the jitter")
+	intFlag(&flags.AuthFailures, "auth-failure-threshold", "AUTH_FAILURE_THRESHOLD", syncer.DefaultAuthFailureThreshold, "Number of authentication failures in a row that pause polling. A negative value never pauses")
+	durationFlag(&flags.CircuitOpenDuration, "circuit-open-duration", "CIRCUIT_OPEN_DURATION", syncer.DefaultCircuitOpenDuration, "How long polling pauses after repeated authentication failures")
+	stringFlag(&flags.QuarantineDir, "quarantine-dir", "QUARANTINE_DIR", "", "Directory corrupt clones are moved to. Default: .git-sync-quarantine next to the clone")
+	intFlag(&flags.QuarantineKeep, "quarantine-keep", "QUARANTINE_KEEP", syncer.DefaultQuarantineKeep, "Number of quarantined clones of each repo kept. A negative value keeps all of them")
+	stringFlag(&flags.StateFile, "state-file", "STATE_FILE", "", "File the sync state is saved to and restored from on startup. Default: git-sync-state.json in the .git directory of the clone")
+	intFlag(&flags.HistoryLimit, "history-limit", "HISTORY_LIMIT", syncer.DefaultHistoryLimit, "Number of sync attempts kept in the history. A negative value disables the history")
+	boolFlag(&flags.PersistHistory, "persist-history", "PERSIST_HISTORY", false, "Save the history to the state file so it survives restarts")
+	intFlag(&flags.Depth, "depth", "DEPTH", 0, "Number of commits fetched from the tip of each reference. 0 fetches the complete history")
+	stringFlag(&flags.Filter, "filter", "FILTER", "", "Partial clone filter, blob:none or blob:limit=<n>[k|m|g]. Blobs left out are fetched when they are checked out")
+	stringFlag(&flags.SparseInclude, "sparse-include", "SPARSE_INCLUDE", "", "Comma separated paths checked out. Default: every path")
+	stringFlag(&flags.SparseExclude, "sparse-exclude", "SPARSE_EXCLUDE", "", "Comma separated paths left out of the checkout")
+	boolFlag(&flags.Submodules, "submodules", "SUBMODULES", false, "Check out the submodules of the synced commit")
+	intFlag(&flags.SubmoduleMaxDepth, "submodule-max-depth", "SUBMODULE_MAX_DEPTH", syncer.DefaultSubmoduleMaxDepth, "How deep submodules are nested. 1 checks out the submodules of the repo but not theirs")
+	stringFlag(&flags.SubmoduleURLs, "submodule-allowed-urls", "SUBMODULE_ALLOWED_URLS", "", "Comma separated patterns of the URLs submodules may be fetched from. Default: every URL")
+	boolFlag(&flags.LFS, "lfs", "LFS", false, "Check out Git LFS files with their content instead of the pointer files")
+	stringFlag(&flags.LFSURL, "lfs-url", "LFS_URL", "", "URL of the LFS server. Default: the info/lfs endpoint of the repo URL")
+	stringFlag(&flags.LFSInclude, "lfs-include", "LFS_INCLUDE", "", "Comma separated patterns of the LFS files downloaded. Default: every file")
+	stringFlag(&flags.LFSExclude, "lfs-exclude", "LFS_EXCLUDE", "", "Comma separated patterns of the LFS files left as pointer files")
+	stringFlag(&flags.LFSCacheDir, "lfs-cache-dir", "LFS_CACHE_DIR", "", "Directory the LFS objects are kept in. Default: lfs/objects in the .git directory of the clone")
+	boolFlag(&flags.EnableWebhook, "webhook-enabled", "WEBHOOK_ENABLED", true, "Enable/Disble the webhook api. Default: true")
+	stringFlag(&flags.WebhookUsername, "webhook-username", "WEBHOOK_USERNAME", "", "Webhook basic auth user")
+	stringFlag(&flags.WebhookPassword, "webhook-password", "WEBHOOK_PASSWORD", "", "Webhook basic auth password")
+	stringFlag(&flags.WebhookPasswordFile, "webhook-password-file", "WEBHOOK_PASSWORD_FILE", "", "Webhook basic auth password file path")
+	stringFlag(&flags.ServerAddr, "server-address", "SERVER_ADDRESS", DefaultServerAddr, "Webhook server address")
+	intFlag(&flags.MaxConcurrentSyncs, "max-concurrent-syncs", "MAX_CONCURRENT_SYNCS", 0, "Maximum number of concurrent clone/fetch operations. 0 means no limit")
+
+	durationFlag(&flags.ShutdownTimeout, "shutdown-timeout", "SHUTDOWN_TIMEOUT", DefaultShutdownTimeout*time.Second, "How long syncs and http requests in progress may take to finish on shutdown")
+	boolFlag(&flags.DegradedStartup, "degraded-startup", "DEGRADED_STARTUP", false, "Start serving an existing worktree when the initial sync fails and keep retrying in the background")
+
+	flag.Parse()
+}
+
+// buildConfig loads the configuration file, if any, applies the flag and
+// environment overrides on top of it and validates the result.
+func buildConfig() (Configuration, error) {
+	file := &configfile.File{}
+	if flags.ConfigFile != "" {
+		loaded, err := configfile.Load(flags.ConfigFile)
+		if err != nil {
+			return Configuration{}, err
+		}
+		file = loaded
+	}
+
+	applyServerOverrides(&file.Server)
+	applyRepoOverrides(file)
+
+	for i := range file.Repos {
+		if file.Repos[i].PollInterval == 0 {
+			file.Repos[i].PollInterval = flags.PollInterval
+		}
+	}
+
+	if err := file.Validate(); err != nil {
+		return Configuration{}, err
+	}
+
+	name := flags.Name
+	if !isOverridden("name") && len(file.Repos) == 1 {
+		name = file.Repos[0].Name
+	}
+
+	cfg := Configuration{
+		Name:                name,
+		EnableWebhook:       *file.Server.Webhook.Enabled,
+		WebhookUsername:     file.Server.Webhook.Username,
+		WebhookPassword:     file.Server.Webhook.Password,
+		WebhookPasswordFile: file.Server.Webhook.PasswordFile,
+		ServerAddr:          file.Server.Address,
+		MaxConcurrentSyncs:  file.Server.MaxConcurrentSyncs,
+		ShutdownTimeout:     file.Server.ShutdownTimeout,
+		DegradedStartup:     file.Server.DegradedStartup,
+		Repos:               file.Repos,
+	}
+	return cfg, nil
+}
+
+func applyServerOverrides(server *configfile.Server) {
+	if isOverridden("server-address") || server.Address == "" {
+		server.Address = flags.ServerAddr
+	}
+	if isOverridden("max-concurrent-syncs") || server.MaxConcurrentSyncs == 0 {
+		server.MaxConcurrentSyncs = flags.MaxConcurrentSyncs
+	}
+	if isOverridden("shutdown-timeout") || server.ShutdownTimeout == 0 {
+		server.ShutdownTimeout = flags.ShutdownTimeout
+	}
+	if isOverridden("degraded-startup") || !server.DegradedStartup {
+		server.DegradedStartup = flags.DegradedStartup
+	}
+	if isOverridden("webhook-enabled") || server.Webhook.Enabled == nil {
+		server.Webhook.Enabled = &flags.EnableWebhook
+	}
+	if isOverridden("webhook-username") || server.Webhook.Username == "" {
+		server.Webhook.Username = flags.WebhookUsername
+	}
+	if isOverridden("webhook-password") || server.Webhook.Password == "" {
+		server.Webhook.Password = flags.WebhookPassword
+	}
+	if isOverridden("webhook-password-file") || server.Webhook.PasswordFile == "" {
+		server.Webhook.PasswordFile = flags.WebhookPasswordFile
+	}
+}
+
+// applyRepoOverrides applies the repo flags to the repo named by --name. When
+// the file has a single repo and --name was not given that repo is used, and
+// when no repo matches a new one is added.
+func applyRepoOverrides(file *configfile.File) {
+	overridden := false
+	for _, name := range repoFlags {
+		overridden = overridden || isOverridden(name)
+	}
+	if !overridden {
+		if len(file.Repos) == 1 && file.Repos[0].Name == "" {
+			file.Repos[0].Name = flags.Name
+		}
+		return
+	}
+
+	var repo *configfile.Repo
+	for i := range file.Repos {
+		if file.Repos[i].Name == flags.Name {
+			repo = &file.Repos[i]
+		}
+	}
+	if repo == nil && len(file.Repos) == 1 && !isOverridden("name") {
+		repo = &file.Repos[0]
+	}
+	if repo == nil {
+		file.Repos = append(file.Repos, configfile.Repo{})
+		repo = &file.Repos[len(file.Repos)-1]
+	}
+	if repo.Name == "" {
+		repo.Name = flags.Name
+	}
+
+	overrideString(&repo.URL, "repo", flags.Repo)
+	overrideString(&repo.Path, "path", flags.Path)
+	overrideString(&repo.CABundleFile, "ca-bundle-file", flags.CABuntleFile)
+	overrideString(&repo.Auth.Username, "username", flags.Username)
+	overrideString(&repo.Auth.Password, "password", flags.Password)
+	overrideString(&repo.Auth.PasswordFile, "password-file", flags.PasswordFile)
+	overrideString(&repo.Auth.SSHPrivateKeyFile, "ssh-key-file", flags.SSHPrivateKeyFile)
+	overrideString(&repo.Auth.KnownHostsFile, "known-hosts-file", flags.KnownHostsFile)
+	if isOverridden("insecure") {
+		repo.Auth.InsecureSkipTLS = flags.InsecureSkipTLS
+	}
+	if isOverridden("interval") {
+		repo.PollInterval = flags.PollInterval
+	}
+	if isOverridden("include-prerelease") {
+		repo.IncludePrerelease = flags.IncludePrerelease
+	}
+	overrideString(&repo.Publish.Root, "publish-root", flags.PublishRoot)
+	overrideString(&repo.QuarantineDir, "quarantine-dir", flags.QuarantineDir)
+	if isOverridden("quarantine-keep") {
+		repo.QuarantineKeep = flags.QuarantineKeep
+	}
+	overrideString(&repo.StateFile, "state-file", flags.StateFile)
+	if isOverridden("depth") {
+		repo.Depth = flags.Depth
+	}
+	overrideString(&repo.Filter, "filter", flags.Filter)
+	if isOverridden("sparse-include") {
+		repo.Sparse.Include = splitList(flags.SparseInclude)
+	}
+	if isOverridden("sparse-exclude") {
+		repo.Sparse.Exclude = splitList(flags.SparseExclude)
+	}
+	if isOverridden("submodules") {
+		repo.Submodules.Enabled = flags.Submodules
+	}
+	if isOverridden("submodule-max-depth") {
+		repo.Submodules.MaxDepth = flags.SubmoduleMaxDepth
+	}
+	if isOverridden("submodule-allowed-urls") {
+		repo.Submodules.AllowedURLs = splitList(flags.SubmoduleURLs)
+	}
+	if isOverridden("lfs") {
+		repo.LFS.Enabled = flags.LFS
+	}
+	overrideString(&repo.LFS.URL, "lfs-url", flags.LFSURL)
+	if isOverridden("lfs-include") {
+		repo.LFS.Include = splitList(flags.LFSInclude)
+	}
+	if isOverridden("lfs-exclude") {
+		repo.LFS.Exclude = splitList(flags.LFSExclude)
+	}
+	overrideString(&repo.LFS.CacheDir, "lfs-cache-dir", flags.LFSCacheDir)
+	if isOverridden("history-limit") {
+		repo.History.Limit = flags.HistoryLimit
+	}
+	if isOverridden("persist-history") {
+		repo.History.Persist = flags.PersistHistory
+	}
+	if isOverridden("keep-revisions") {
+		repo.Publish.KeepRevisions = flags.KeepRevisions
+	}
+	if isOverridden("pre-sync-hook") {
+		repo.Hooks.PreSync = shellHook(flags.PreSyncHook, flags.HookTimeout)
+	}
+	if isOverridden("post-sync-hook") {
+		repo.Hooks.PostSync = shellHook(flags.PostSyncHook, flags.HookTimeout)
+	}
+	if isOverridden("notify-url") {
+		repo.Notifications = nil
+		if flags.NotifyURL != "" {
+			n := configfile.Notification{URL: flags.NotifyURL, Secret: flags.NotifySecret}
+			if flags.NotifyEvents != "" {
+				n.Events = splitList(flags.NotifyEvents)
+			}
+			repo.Notifications = append(repo.Notifications, n)
+		}
+	}
+	if isOverridden("clone-timeout") {
+		repo.Timeouts.Clone = flags.CloneTimeout
+	}
+	if isOverridden("fetch-timeout") {
+		repo.Timeouts.Fetch = flags.FetchTimeout
+	}
+	if isOverridden("checkout-timeout") {
+		repo.Timeouts.Checkout = flags.CheckoutTimeout
+	}
+	if isOverridden("retry-backoff") {
+		repo.Retry.InitialBackoff = flags.RetryBackoff
+	}
+	if isOverridden("retry-max-backoff") {
+		repo.Retry.MaxBackoff = flags.RetryMaxBackoff
+	}
+	if isOverridden("poll-jitter") {
+		repo.Retry.Jitter = flags.PollJitter
+	}
+	if isOverridden("auth-failure-threshold") {
+		repo.Retry.AuthFailureThreshold = flags.AuthFailures
+	}
+	if isOverridden("circuit-open-duration") {
+		repo.Retry.CircuitOpenDuration = flags.CircuitOpenDuration
+	}
+
+	// The ref takes precedence over the branch, so a branch override only
+	// applies when no ref was given on the command line.
+	switch {
+	case isOverridden("ref") && flags.Ref != "":
+		repo.Ref = flags.Ref
+	case isOverridden("branch"):
+		repo.Branch = flags.Branch
+		repo.Ref = ""
+	}
+}
+
+// shellHook returns a hook that runs command with sh, or no hook when command
+// is empty.
+func shellHook(command string, timeout time.Duration) []configfile.Hook {
+	if command == "" {
+		return nil
+	}
+	return []configfile.Hook{{Name: command, Command: []string{"sh", "-c", command}, Timeout: timeout}}
+}
+
+func overrideString(field *string, name string, value string) {
+	if isOverridden(name) {
+		*field = value
+	}
+}
+
+// splitList splits a comma separated flag value. An empty value is an empty
+// list.
+func splitList(value string) []string {
+	value = strings.ReplaceAll(value, " ", "")
+	if value == "" {
+		return nil
+	}
+	return strings.Split(value, ",")
+}
+
+// isOverridden reports whether the flag was given on the command line or
+// through its environment variable. Without a configuration file every flag
+// counts as given.
+func isOverridden(name string) bool {
+	if flags.ConfigFile == "" {
+		return true
+	}
+
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set || os.Getenv(flagEnvs[name]) != ""
+}
+
+func stringFlag(p *string, name, env, fallback, usage string) {
+	flagEnvs[name] = env
+	flag.StringVar(p, name, getEnv(env, fallback), usage)
+}
+
+func boolFlag(p *bool, name, env string, fallback bool, usage string) {
+	flagEnvs[name] = env
+	flag.BoolVar(p, name, getEnvBool(env, fallback), usage)
+}
+
+func intFlag(p *int, name, env string, fallback int, usage string) {
+	flagEnvs[name] = env
+	flag.IntVar(p, name, getEnvInt(env, fallback), usage)
+}
+
+func floatFlag(p *float64, name, env string, fallback float64, usage string) {
+	flagEnvs[name] = env
+	flag.Float64Var(p, name, getEnvFloat(env, fallback), usage)
+}
+
+func durationFlag(p *time.Duration, name, env string, fallback time.Duration, usage string) {
+	flagEnvs[name] = env
+	flag.DurationVar(p, name, getEnvDuration(env, fallback), usage)
+}
+
+func getEnv(key, fallback string) string {
+	if val := os.Getenv(key); val != "" {
+		return val
+	}
+	return fallback
+}
+
+func getEnvBool(key string, fallback bool) bool {
+	valStr := os.Getenv(key)
+	if valStr == "" {
+		return fallback
+	}
+
+	val, err := strconv.ParseBool(valStr)
+	if err != nil {
+		return false
+	}
+	return val
+}
+
+func getEnvInt(key string, fallback int) int {
+	if val := os.Getenv(key); val != "" {
+		i, err := strconv.Atoi(val)
+		if err == nil {
+			return i
+		}
+		log.Printf("Invalid integer for %s: %s", key, val)
+	}
+	return fallback
+}
+
+func getEnvFloat(key string, fallback float64) float64 {
+	if val := os.Getenv(key); val != "" {
+		f, err := strconv.ParseFloat(val, 64)
+		if err == nil {
+			return f
+		}
+		log.Printf("Invalid number for %s: %s", key, val)
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if val := os.Getenv(key); val != "" {
+		dur, err := time.ParseDuration(val)
+		if err == nil {
+			return dur
+		}
+		log.Printf("Invalid duration for %s: %s", key, val)
+	}
+	return fallback
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// parseFlags parses args and the environment into flags like the process
+// does on startup.
+func parseFlags(t *testing.T, env map[string]string, args ...string) {
+	t.Helper()
+
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+	commandLine, osArgs := flag.CommandLine, os.Args
+	t.Cleanup(func() {
+		flag.CommandLine, os.Args = commandLine, osArgs
+		flags = flagValues{}
+		flagEnvs = map[string]string{}
+	})
+
+	flag.CommandLine = flag.NewFlagSet("git-sync", flag.ContinueOnError)
+	os.Args = append([]string{"git-sync"}, args...)
+	flags = flagValues{}
+	flagEnvs = map[string]string{}
+	loadFlags()
+}
+
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+const precedenceConfig = `
+server:
+  address: ":1000"
+repos:
+  - name: app
+    url: https://example.com/app.git
+    path: /data/app
+    depth: 5
+`
+
+func TestConfigPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		address string
+		depth   int
+	}{
+		{name: "file", address: ":1000", depth: 5},
+		{
+			name:    "env over file",
+			env:     map[string]string{"SERVER_ADDRESS": ":2000", "DEPTH": "2"},
+			address: ":2000",
+			depth:   2,
+		},
+		{
+			name:    "flag over env",
+			env:     map[string]string{"SERVER_ADDRESS": ":2000", "DEPTH": "2"},
+			args:    []string{"--server-address", ":3000", "--depth", "3"},
+			address: ":3000",
+			depth:   3,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string{"--config", writeConfig(t, precedenceConfig)}, tc.args...)
+			parseFlags(t, tc.env, args...)
+
+			cfg, err := buildConfig()
+			require.NoError(t, err)
+			require.Equal(t, tc.address, cfg.ServerAddr)
+			require.Len(t, cfg.Repos, 1)
+			require.Equal(t, "app", cfg.Name)
+			require.Equal(t, tc.depth, cfg.Repos[0].Depth)
+			require.Equal(t, "/data/app", cfg.Repos[0].Path, "values that are not overridden are kept")
+		})
+	}
+}
+
+func TestConfigRepoOverrides(t *testing.T) {
+	const twoRepos = `
+repos:
+  - name: app
+    url: https://example.com/app.git
+    path: /data/app
+  - name: docs
+    url: https://example.com/docs.git
+    path: /data/docs
+`
+
+	for _, tc := range []struct {
+		name   string
+		config string
+		args   []string
+		// depths are the depths of the repos by name.
+		depths map[string]int
+	}{
+		{
+			name:   "single repo without name",
+			config: precedenceConfig,
+			args:   []string{"--depth", "1"},
+			depths: map[string]int{"app": 1},
+		},
+		{
+			name:   "repo named by name",
+			config: twoRepos,
+			args:   []string{"--name", "docs", "--depth", "1"},
+			depths: map[string]int{"app": 0, "docs": 1},
+		},
+		{
+			name:   "new repo",
+			config: twoRepos,
+			args:   []string{"--name", "api", "--repo", "https://example.com/api.git", "--path", "/data/api", "--depth", "1"},
+			depths: map[string]int{"app": 0, "docs": 0, "api": 1},
+		},
+		{
+			name:   "new repo next to a single one",
+			config: precedenceConfig,
+			args:   []string{"--name", "api", "--repo", "https://example.com/api.git", "--path", "/data/api"},
+			depths: map[string]int{"app": 5, "api": 0},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			args := append([]string{"--config", writeConfig(t, tc.config)}, tc.args...)
+			parseFlags(t, nil, args...)
+
+			cfg, err := buildConfig()
+			require.NoError(t, err)
+			depths := map[string]int{}
+			for _, repo := range cfg.Repos {
+				depths[repo.Name] = repo.Depth
+			}
+			require.Equal(t, tc.depths, depths)
+		})
+	}
+}
+
+func TestConfigWithoutFile(t *testing.T) {
+	parseFlags(t, map[string]string{"GIT_REPO": "https://example.com/app.git", "TARGET_PATH": "/data/app"}, "--branch", "release")
+
+	cfg, err := buildConfig()
+	require.NoError(t, err)
+	require.Len(t, cfg.Repos, 1)
+	repo := cfg.Repos[0]
+	require.Equal(t, DefaultRepoName, repo.Name)
+	require.Equal(t, "https://example.com/app.git", repo.URL)
+	require.Equal(t, "/data/app", repo.Path)
+	require.Equal(t, "release", repo.Branch)
+	require.Equal(t, DefaultServerAddr, cfg.ServerAddr)
+}
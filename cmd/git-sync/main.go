@@ -1,101 +1,195 @@
 package main
 
 import (
-	"flag"
+	"context"
+	"errors"
 	"log"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
+	"os/signal"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/clbiggs/git-sync/internal/handlers"
 	"github.com/clbiggs/git-sync/internal/middleware"
 	"github.com/clbiggs/git-sync/pkg/git/syncer"
-	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type Configuration struct {
-	Repo                string
-	Path                string
-	RefName             string
-	CABuntleFile        string
-	Username            string
-	Password            string
-	PasswordFile        string
-	SSHPrivateKeyFile   string
-	InsecureSkipTLS     bool
-	KnownHostsFile      string
-	PollInterval        time.Duration
-	EnableWebhook       bool
-	WebhookUsername     string
-	WebhookPassword     string
-	WebhookPasswordFile string
-	ServerAddr          string
-}
-
 const (
 	DefaultInterval            = 900
 	DefaultServerAddr          = ":8080"
 	DefaultServerHeaderTimeout = 3
+	DefaultRepoName            = "default"
+	DefaultConfigCheckInterval = 10
+	// DefaultShutdownTimeout leaves room within the default 30s grace period
+	// of Kubernetes.
+	DefaultShutdownTimeout = 25
+)
+
+// Exit codes.
+const (
+	ExitOK    = 0
+	ExitError = 1
+	// ExitShutdownTimeout means syncs or http requests did not finish within
+	// the shutdown timeout and were canceled.
+	ExitShutdownTimeout = 2
 )
 
 var config Configuration
 
 func main() {
-	loadConfigFromFlagsOrEnv()
-	validateConfig()
-
-	sync := syncer.NewSyncer(syncer.SyncOptions{
-		Path:         config.Path,
-		RefName:      plumbing.ReferenceName(config.RefName),
-		CABuntleFile: config.CABuntleFile,
-		PollInterval: config.PollInterval,
-		Auth: syncer.AuthOptions{
-			Repo:              config.Repo,
-			Username:          config.Username,
-			Password:          config.Password,
-			PasswordFile:      config.PasswordFile,
-			SSHPrivateKeyFile: config.SSHPrivateKeyFile,
-			InsecureSkipTLS:   config.InsecureSkipTLS,
-			KnownHostsFile:    config.KnownHostsFile,
-		},
-	})
-
-	// Perform initial sync
-	log.Printf("Performing Initial Sync...: %s", sync.Options.Auth.Repo)
-	err := sync.ForceSync()
+	loadFlags()
+
+	// ctx is done on the first SIGTERM or interrupt. Once stop is called a
+	// second signal kills the process right away.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+
+	var err error
+	config, err = buildConfig()
 	if err != nil {
-		log.Printf("failed initial sync: %v", err)
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
 
-		log.Println("Deleting local files and attempting re-clone...")
-		err = os.RemoveAll(config.Path)
-		if err != nil {
-			log.Fatalf("Error deleting local files: %v", err)
-		}
+	if err = syncer.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		log.Fatalf("Error registering metrics: %v", err)
+	}
 
-		err = sync.ForceSync()
-		if err != nil {
-			log.Fatalf("failed to re-clone repo: %v", err)
+	manager := syncer.NewManager(config.MaxConcurrentSyncs)
+	for i := range config.Repos {
+		repo := &config.Repos[i]
+		if _, err = manager.Add(repo.Name, repo.SyncOptions()); err != nil {
+			log.Fatalf("Error creating syncer: %v", err)
 		}
 	}
-	log.Println("Initial Sync Completed.")
 
-	// Start polling and syncing repo.
-	sync.Start()
+	if !config.DegradedStartup {
+		initialSync(ctx, manager, true)
+		if ctx.Err() != nil {
+			log.Println("Shut down during the initial sync.")
+			os.Exit(ExitError)
+		}
 
-	server, err := setupHTTPServer(config.ServerAddr, sync)
+		// Start polling and syncing repos.
+		manager.Start()
+	}
+
+	server, err := setupHTTPServer(config.ServerAddr, manager)
 	if err != nil {
 		log.Fatalf("Error building router: %v", err)
 	}
 
 	log.Printf("Server started on %s", config.ServerAddr)
-	log.Fatal(server.ListenAndServe())
+	go watchConfig(ctx, manager)
+
+	if config.DegradedStartup {
+		// Serve right away. Repos whose initial sync fails keep their
+		// worktree and are retried by polling.
+		go func() {
+			initialSync(ctx, manager, false)
+			if ctx.Err() == nil {
+				manager.Start()
+			}
+		}()
+	}
+
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.ListenAndServe()
+	}()
+
+	code := ExitOK
+	select {
+	case err = <-serverErr:
+		log.Printf("Server failed: %v", err)
+		code = ExitError
+	case <-ctx.Done():
+		log.Println("Received shutdown signal, shutting down...")
+	}
+	stop()
+
+	if err = shutdown(server, manager); err != nil {
+		log.Printf("Shutdown did not complete within %s: %v", config.ShutdownTimeout, err)
+		code = max(code, ExitShutdownTimeout)
+	} else {
+		log.Println("Shutdown completed.")
+	}
+	os.Exit(code)
+}
+
+// shutdown stops accepting requests and waits, within the shutdown timeout,
+// for the http requests and syncs in progress to finish. Syncs that do not
+// finish in time are canceled.
+func shutdown(server *http.Server, manager *syncer.Manager) error {
+	ctx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
+
+	// Webhook requests wait for syncs, so both are drained at the same time.
+	var serverErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serverErr = server.Shutdown(ctx)
+	}()
+
+	err := manager.Shutdown(ctx)
+	wg.Wait()
+	return errors.Join(err, serverErr)
+}
+
+// initialSync performs the initial sync of every repo concurrently. A repo
+// whose local clone is corrupt is moved to quarantine and cloned again. It
+// gives up when ctx is done. Failures exit the process if fatal is set and
+// are logged otherwise.
+func initialSync(ctx context.Context, manager *syncer.Manager, fatal bool) {
+	fail := log.Printf
+	if fatal {
+		fail = log.Fatalf
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range manager.Names() {
+		s, _ := manager.Get(name)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			log.Printf("Performing Initial Sync...: %s", s.Options.Auth.Repo)
+			err := s.ForceSyncContext(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			if errors.Is(err, syncer.ErrWorktreeCorrupt) {
+				log.Printf("failed initial sync, the local clone is corrupt: %v", err)
+
+				if _, err = s.Quarantine(); err != nil {
+					fail("Error moving the local clone to quarantine: %v", err)
+					return
+				}
+
+				log.Println("Attempting re-clone...")
+				err = s.ForceSyncContext(ctx)
+				if ctx.Err() != nil {
+					return
+				}
+			}
+			if err != nil {
+				fail("failed initial sync: %v", err)
+				return
+			}
+			log.Printf("Initial Sync Completed: %s", name)
+		}()
+	}
+	wg.Wait()
 }
 
-func setupHTTPServer(serverAddress string, sync *syncer.Syncer) (*http.Server, error) {
-	router, err := setupRouter(sync)
+func setupHTTPServer(serverAddress string, manager *syncer.Manager) (*http.Server, error) {
+	router, err := setupRouter(manager)
 	if err != nil {
 		return nil, err
 	}
@@ -107,7 +201,7 @@ func setupHTTPServer(serverAddress string, sync *syncer.Syncer) (*http.Server, e
 	}, nil
 }
 
-func setupRouter(sync *syncer.Syncer) (*mux.Router, error) {
+func setupRouter(manager *syncer.Manager) (*mux.Router, error) {
 	router := mux.NewRouter()
 	var password string
 	if config.WebhookPasswordFile != "" {
@@ -120,102 +214,33 @@ func setupRouter(sync *syncer.Syncer) (*mux.Router, error) {
 		password = config.WebhookPassword
 	}
 
-	if config.EnableWebhook {
-		router.HandleFunc("/webhook", middleware.BasicAuthMiddleware(handlers.WebhookHandler(sync), config.WebhookUsername, password)).Methods("POST")
-	}
-	router.HandleFunc("/status", handlers.StatusHandler(sync)).Methods("GET")
-	router.HandleFunc("/liveness", handlers.LivenessHandler()).Methods("GET")
-
-	return router, nil
-}
-
-func loadConfigFromFlagsOrEnv() {
-	repo := flag.String("repo", os.Getenv("GIT_REPO"), "Git repo URL")
-	path := flag.String("path", os.Getenv("TARGET_PATH"), "Local repo path")
-	branch := flag.String("branch", getEnv("BRANCH", "main"), "Branch to track. The <ref> argument takes precident over this.")
-	ref := flag.String("ref", os.Getenv("REF_NAME"), "Reference name. Use the refs/heads/main or refs/tags/v1.0.0 format.")
-	bundleFile := flag.String("ca-bundle-file", os.Getenv("CA_BUNDLE"), "CA Certificate bundle file path")
-	interval := flag.Duration("interval", getEnvDuration("POLL_INTERVAL", DefaultInterval*time.Second), "Polling interval")
-	username := flag.String("username", os.Getenv("GIT_USERNAME"), "Git username/token")
-	password := flag.String("password", os.Getenv("GIT_PASSWORD"), "Git password/token")
-	passwordFile := flag.String("password-file", os.Getenv("GIT_PASSWORD_FILE"), "Path to file containing Git password/token")
-	sshFile := flag.String("ssh-key-file", os.Getenv("GIT_SSHKEY_FILE"), "Path to file containing Git SSH Private key")
-	insecure := flag.Bool("insecure", getEnvBool("INSECURE_TLS", false), "Use insecure TLS connection")
-	knownHosts := flag.String("known-hosts-file", os.Getenv("KNOWN_HOSTS_FILE"), "Path to file containing known hosts")
-	enableWebhook := flag.Bool("webhook-enabled", getEnvBool("WEBHOOK_ENABLED", true), "Enable/Disble the webhook api. Default: true")
-	webUsername := flag.String("webhook-username", os.Getenv("WEBHOOK_USERNAME"), "Webhook basic auth user")
-	webPassword := flag.String("webhook-password", os.Getenv("WEBHOOK_PASSWORD"), "Webhook basic auth password")
-	webPasswordFile := flag.String("webhook-password-file", os.Getenv("WEBHOOK_PASSWORD_FILE"), "Webhook basic auth password file path")
-	serverAddr := flag.String("server-address", getEnv("SERVER_ADDRESS", DefaultServerAddr), "Webhook server address")
-
-	flag.Parse()
-
-	refname := *ref
-	if refname == "" {
-		refname = "refs/heads/" + *branch
+	auth := func(next http.Handler) http.HandlerFunc {
+		return middleware.BasicAuthMiddleware(next, config.WebhookUsername, password)
 	}
 
-	config = Configuration{
-		Repo:                *repo,
-		Path:                *path,
-		RefName:             refname,
-		CABuntleFile:        *bundleFile,
-		Username:            *username,
-		Password:            *password,
-		PasswordFile:        *passwordFile,
-		SSHPrivateKeyFile:   *sshFile,
-		InsecureSkipTLS:     *insecure,
-		KnownHostsFile:      *knownHosts,
-		PollInterval:        *interval,
-		EnableWebhook:       *enableWebhook,
-		WebhookUsername:     *webUsername,
-		WebhookPassword:     *webPassword,
-		WebhookPasswordFile: *webPasswordFile,
-		ServerAddr:          *serverAddr,
-	}
-}
-
-func validateConfig() {
-	missing := []string{}
-	if config.Repo == "" {
-		missing = append(missing, "repo")
-	}
-	if config.Path == "" {
-		missing = append(missing, "path")
-	}
-
-	if len(missing) > 0 {
-		log.Fatalf("Missing required parameters: %s", strings.Join(missing, ", "))
-	}
-}
-
-func getEnv(key, fallback string) string {
-	if val := os.Getenv(key); val != "" {
-		return val
-	}
-	return fallback
-}
-
-func getEnvBool(key string, fallback bool) bool {
-	valStr := os.Getenv(key)
-	if valStr == "" {
-		return fallback
+	// The top level endpoints address the default repo.
+	name := config.Name
+	if config.EnableWebhook {
+		router.HandleFunc("/webhook", auth(handlers.WebhookHandler(manager, name))).Methods("POST")
+		router.HandleFunc("/pin", auth(handlers.PinHandler(manager, name))).Methods("POST")
+		router.HandleFunc("/pin", auth(handlers.UnpinHandler(manager, name))).Methods("DELETE")
+		router.HandleFunc("/cancel", auth(handlers.CancelHandler(manager, name))).Methods("POST")
 	}
+	router.HandleFunc("/status", handlers.StatusHandler(manager, name)).Methods("GET")
+	router.HandleFunc("/history", handlers.HistoryHandler(manager, name)).Methods("GET")
 
-	val, err := strconv.ParseBool(valStr)
-	if err != nil {
-		return false
+	if config.EnableWebhook {
+		router.HandleFunc("/repos/{name}/webhook", auth(handlers.RepoWebhookHandler(manager))).Methods("POST")
+		router.HandleFunc("/repos/{name}/pin", auth(handlers.RepoPinHandler(manager))).Methods("POST")
+		router.HandleFunc("/repos/{name}/pin", auth(handlers.RepoUnpinHandler(manager))).Methods("DELETE")
+		router.HandleFunc("/repos/{name}/cancel", auth(handlers.RepoCancelHandler(manager))).Methods("POST")
 	}
-	return val
-}
+	router.HandleFunc("/repos", handlers.ReposHandler(manager)).Methods("GET")
+	router.HandleFunc("/repos/{name}/status", handlers.RepoStatusHandler(manager)).Methods("GET")
+	router.HandleFunc("/repos/{name}/history", handlers.RepoHistoryHandler(manager)).Methods("GET")
+	router.HandleFunc("/liveness", handlers.LivenessHandler()).Methods("GET")
+	router.HandleFunc("/readiness", handlers.ReadinessHandler(manager)).Methods("GET")
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
 
-func getEnvDuration(key string, fallback time.Duration) time.Duration {
-	if val := os.Getenv(key); val != "" {
-		dur, err := time.ParseDuration(val)
-		if err == nil {
-			return dur
-		}
-		log.Printf("Invalid duration for %s: %s", key, val)
-	}
-	return fallback
+	return router, nil
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/clbiggs/git-sync/pkg/git/syncer"
+)
+
+// watchConfig reloads the configuration when the process receives SIGHUP and,
+// when a configuration file is used, whenever the content of the file changes,
+// until ctx is done.
+func watchConfig(ctx context.Context, manager *syncer.Manager) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var check <-chan time.Time
+	var lastSum [sha256.Size]byte
+	if flags.ConfigFile != "" && flags.ConfigCheckInterval > 0 {
+		lastSum, _ = fileChecksum(flags.ConfigFile)
+
+		ticker := time.NewTicker(flags.ConfigCheckInterval)
+		defer ticker.Stop()
+		check = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			log.Println("Received SIGHUP, reloading configuration...")
+		case <-check:
+			sum, err := fileChecksum(flags.ConfigFile)
+			if err != nil {
+				log.Printf("Error reading configuration file: %v", err)
+				continue
+			}
+			if sum == lastSum {
+				continue
+			}
+			lastSum = sum
+			log.Println("Configuration file changed, reloading configuration...")
+		}
+
+		reloadConfig(manager)
+	}
+}
+
+// reloadConfig rebuilds and validates the configuration and applies the repo
+// settings to the manager. An invalid configuration is logged and ignored.
+func reloadConfig(manager *syncer.Manager) {
+	newConfig, err := buildConfig()
+	if err != nil {
+		log.Printf("Invalid configuration, keeping the current one:\n%v", err)
+		return
+	}
+
+	if newConfig.EnableWebhook != config.EnableWebhook ||
+		newConfig.WebhookUsername != config.WebhookUsername ||
+		newConfig.WebhookPassword != config.WebhookPassword ||
+		newConfig.WebhookPasswordFile != config.WebhookPasswordFile ||
+		newConfig.ServerAddr != config.ServerAddr ||
+		newConfig.MaxConcurrentSyncs != config.MaxConcurrentSyncs ||
+		newConfig.ShutdownTimeout != config.ShutdownTimeout ||
+		newConfig.DegradedStartup != config.DegradedStartup {
+		log.Println("Server settings changed, they are applied on the next restart.")
+	}
+
+	options := make(map[string]syncer.SyncOptions, len(newConfig.Repos))
+	for i := range newConfig.Repos {
+		repo := &newConfig.Repos[i]
+		options[repo.Name] = repo.SyncOptions()
+	}
+	manager.Apply(options)
+
+	config.Repos = newConfig.Repos
+	log.Println("Configuration reloaded.")
+}
+
+func fileChecksum(path string) ([sha256.Size]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
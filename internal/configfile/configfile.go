@@ -0,0 +1,647 @@
+// Package configfile loads the declarative git-sync configuration file.
+//
+// The file is YAML. Every scalar may reference environment variables with the
+// ${NAME} syntax, and every error found while loading or validating the file
+// is reported with the file name and line it refers to.
+package configfile
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/clbiggs/git-sync/pkg/git/syncer"
+	"github.com/go-git/go-git/v5/plumbing"
+	"gopkg.in/yaml.v3"
+)
+
+const DefaultBranch = "main"
+
+type File struct {
+	Server Server `yaml:"server"`
+	Repos  []Repo `yaml:"repos"`
+
+	name string
+}
+
+type Server struct {
+	Address            string `yaml:"address"`
+	MaxConcurrentSyncs int    `yaml:"maxConcurrentSyncs"`
+	// ShutdownTimeout is how long syncs and http requests in progress may
+	// take to finish on shutdown.
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	// DegradedStartup starts the server even when the initial sync fails,
+	// serving the worktree left by an earlier run.
+	DegradedStartup bool    `yaml:"degradedStartup"`
+	Webhook         Webhook `yaml:"webhook"`
+}
+
+type Webhook struct {
+	Enabled      *bool  `yaml:"enabled"`
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"passwordFile"`
+}
+
+type Repo struct {
+	Name         string        `yaml:"name"`
+	URL          string        `yaml:"url"`
+	Path         string        `yaml:"path"`
+	Branch       string        `yaml:"branch"`
+	Ref          string        `yaml:"ref"`
+	CABundleFile string        `yaml:"caBundleFile"`
+	PollInterval time.Duration `yaml:"pollInterval"`
+	Auth         Auth          `yaml:"auth"`
+	Publish      Publish       `yaml:"publish"`
+	// IncludePrerelease lets a semver ref match pre-release tags.
+	IncludePrerelease bool           `yaml:"includePrerelease"`
+	Hooks             Hooks          `yaml:"hooks"`
+	Notifications     []Notification `yaml:"notifications"`
+	Timeouts          Timeouts       `yaml:"timeouts"`
+	Retry             Retry          `yaml:"retry"`
+	QuarantineDir     string         `yaml:"quarantineDir"`
+	QuarantineKeep    int            `yaml:"quarantineKeep"`
+	StateFile         string         `yaml:"stateFile"`
+	History           History        `yaml:"history"`
+	Depth             int            `yaml:"depth"`
+	Filter            string         `yaml:"filter"`
+	Sparse            Sparse         `yaml:"sparse"`
+	Submodules        Submodules     `yaml:"submodules"`
+	LFS               LFS            `yaml:"lfs"`
+
+	node *yaml.Node
+}
+
+type Auth struct {
+	Username          string `yaml:"username"`
+	Password          string `yaml:"password"`
+	PasswordFile      string `yaml:"passwordFile"`
+	SSHPrivateKeyFile string `yaml:"sshKeyFile"`
+	KnownHostsFile    string `yaml:"knownHostsFile"`
+	InsecureSkipTLS   bool   `yaml:"insecureSkipTLS"`
+}
+
+type Publish struct {
+	Root          string `yaml:"root"`
+	KeepRevisions int    `yaml:"keepRevisions"`
+}
+
+// Timeouts limit the phases of a sync. Zero means no limit.
+type Timeouts struct {
+	Clone    time.Duration `yaml:"clone"`
+	Fetch    time.Duration `yaml:"fetch"`
+	Checkout time.Duration `yaml:"checkout"`
+}
+
+// Retry is the retry policy of a repo, see syncer.RetryPolicy.
+type Retry struct {
+	InitialBackoff       time.Duration `yaml:"initialBackoff"`
+	MaxBackoff           time.Duration `yaml:"maxBackoff"`
+	Jitter               float64       `yaml:"jitter"`
+	AuthFailureThreshold int           `yaml:"authFailureThreshold"`
+	CircuitOpenDuration  time.Duration `yaml:"circuitOpenDuration"`
+}
+
+// Sparse selects the paths checked out, see syncer.SparseOptions.
+type Sparse struct {
+	Include []string `yaml:"include"`
+	Exclude []string `yaml:"exclude"`
+}
+
+// Submodules configures the checkout of submodules, see
+// syncer.SubmoduleOptions.
+type Submodules struct {
+	Enabled     bool     `yaml:"enabled"`
+	MaxDepth    int      `yaml:"maxDepth"`
+	AllowedURLs []string `yaml:"allowedURLs"`
+	// Auth overrides the credentials of the repo for the submodule at the
+	// path.
+	Auth map[string]Auth `yaml:"auth"`
+}
+
+// LFS configures the download of Git LFS objects, see syncer.LFSOptions.
+type LFS struct {
+	Enabled  bool     `yaml:"enabled"`
+	URL      string   `yaml:"url"`
+	Include  []string `yaml:"include"`
+	Exclude  []string `yaml:"exclude"`
+	CacheDir string   `yaml:"cacheDir"`
+}
+
+// History configures the sync history, see syncer.HistoryOptions.
+type History struct {
+	Limit   int  `yaml:"limit"`
+	Persist bool `yaml:"persist"`
+}
+
+type Hooks struct {
+	PreSync  []Hook `yaml:"preSync"`
+	PostSync []Hook `yaml:"postSync"`
+}
+
+type Hook struct {
+	Name    string        `yaml:"name"`
+	Command []string      `yaml:"command"`
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+type Notification struct {
+	Name        string        `yaml:"name"`
+	URL         string        `yaml:"url"`
+	Secret      string        `yaml:"secret"`
+	SecretFile  string        `yaml:"secretFile"`
+	Events      []string      `yaml:"events"`
+	Template    string        `yaml:"template"`
+	Timeout     time.Duration `yaml:"timeout"`
+	MaxAttempts int           `yaml:"maxAttempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+}
+
+// Error is a problem found in a configuration file. Line is zero when the
+// problem does not refer to a specific line, e.g. a value set by a flag.
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	switch {
+	case e.File != "" && e.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	case e.File != "":
+		return fmt.Sprintf("%s: %s", e.File, e.Msg)
+	default:
+		return e.Msg
+	}
+}
+
+// Load reads and parses the configuration file at path.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return Parse(path, data)
+}
+
+// Parse parses the configuration in data. The name is only used in errors.
+// Unknown keys, undefined environment variables and malformed values are all
+// reported together.
+func Parse(name string, data []byte) (*File, error) {
+	file := &File{name: name}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, &Error{File: name, Msg: err.Error()}
+	}
+	if len(root.Content) == 0 {
+		return file, nil
+	}
+	doc := root.Content[0]
+
+	var errs []error
+	errs = append(errs, expandEnv(name, doc)...)
+	errs = append(errs, checkKeys(name, doc, reflect.TypeOf(*file))...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if err := doc.Decode(file); err != nil {
+		return nil, decodeError(name, err)
+	}
+
+	if repos := mappingValue(doc, "repos"); repos != nil {
+		for i := range file.Repos {
+			file.Repos[i].node = repos.Content[i]
+		}
+	}
+
+	return file, nil
+}
+
+// Name returns the name of the file the configuration was loaded from.
+func (f *File) Name() string {
+	return f.name
+}
+
+// Validate checks the configuration and returns every problem found.
+func (f *File) Validate() error {
+	var errs []error
+
+	if len(f.Repos) == 0 {
+		errs = append(errs, f.errorf(nil, "", "at least one repo is required"))
+	}
+	if f.Server.MaxConcurrentSyncs < 0 {
+		errs = append(errs, f.errorf(nil, "", "server.maxConcurrentSyncs must not be negative"))
+	}
+	if f.Server.ShutdownTimeout < 0 {
+		errs = append(errs, f.errorf(nil, "", "server.shutdownTimeout must not be negative"))
+	}
+
+	names := map[string]bool{}
+	paths := map[string]bool{}
+	stateFiles := map[string]bool{}
+	for i := range f.Repos {
+		r := &f.Repos[i]
+
+		if r.Name == "" {
+			errs = append(errs, f.errorf(r, "name", "repos[%d]: name is required", i))
+		} else if names[r.Name] {
+			errs = append(errs, f.errorf(r, "name", "repos[%d]: duplicate name %q", i, r.Name))
+		}
+		names[r.Name] = true
+
+		if r.URL == "" {
+			errs = append(errs, f.errorf(r, "url", "repos[%d]: url is required", i))
+		}
+
+		if r.Path == "" {
+			errs = append(errs, f.errorf(r, "path", "repos[%d]: path is required", i))
+		} else if paths[r.Path] {
+			errs = append(errs, f.errorf(r, "path", "repos[%d]: path %q is used by another repo", i, r.Path))
+		}
+		paths[r.Path] = true
+
+		if _, err := syncer.ParseSemverConstraint(r.RefName()); err != nil {
+			errs = append(errs, f.errorf(r, "ref", "repos[%d]: %v", i, err))
+		}
+
+		if r.PollInterval <= 0 {
+			errs = append(errs, f.errorf(r, "pollInterval", "repos[%d]: pollInterval must be positive", i))
+		}
+
+		if r.Publish.KeepRevisions < 0 {
+			errs = append(errs, f.errorf(r, "publish", "repos[%d]: publish.keepRevisions must not be negative", i))
+		}
+		if r.Publish.Root != "" && r.Publish.Root == r.Path {
+			errs = append(errs, f.errorf(r, "publish", "repos[%d]: publish.root must differ from path", i))
+		}
+
+		if r.QuarantineDir != "" && r.Path != "" {
+			if rel, err := filepath.Rel(r.Path, r.QuarantineDir); err == nil && filepath.IsLocal(rel) {
+				errs = append(errs, f.errorf(r, "quarantineDir", "repos[%d]: quarantineDir must be outside of path", i))
+			}
+		}
+
+		if r.Depth < 0 {
+			errs = append(errs, f.errorf(r, "depth", "repos[%d]: depth must not be negative", i))
+		}
+		if r.Filter != "" {
+			if _, err := syncer.ParseFilter(r.Filter); err != nil {
+				errs = append(errs, f.errorf(r, "filter", "repos[%d]: %v", i, err))
+			}
+		}
+		for _, p := range slices.Concat(r.Sparse.Include, r.Sparse.Exclude) {
+			if !filepath.IsLocal(p) {
+				errs = append(errs, f.errorf(r, "sparse", "repos[%d]: sparse path %q must be relative to the repository root", i, p))
+			}
+		}
+
+		if r.Submodules.MaxDepth < 0 {
+			errs = append(errs, f.errorf(r, "submodules", "repos[%d]: submodules.maxDepth must not be negative", i))
+		}
+		for _, pattern := range r.Submodules.AllowedURLs {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, f.errorf(r, "submodules", "repos[%d]: submodules.allowedURLs: invalid pattern %q", i, pattern))
+			}
+		}
+		for p := range r.Submodules.Auth {
+			if !filepath.IsLocal(p) {
+				errs = append(errs, f.errorf(r, "submodules", "repos[%d]: submodules.auth: path %q must be relative to the repository root", i, p))
+			}
+		}
+
+		if r.LFS.URL != "" {
+			if u, err := url.Parse(r.LFS.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				errs = append(errs, f.errorf(r, "lfs", "repos[%d]: lfs.url must be an absolute http or https url", i))
+			}
+		}
+		for _, pattern := range slices.Concat(r.LFS.Include, r.LFS.Exclude) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				errs = append(errs, f.errorf(r, "lfs", "repos[%d]: lfs: invalid pattern %q", i, pattern))
+			}
+		}
+
+		if r.StateFile != "" {
+			if stateFiles[r.StateFile] {
+				errs = append(errs, f.errorf(r, "stateFile", "repos[%d]: stateFile %q is used by another repo", i, r.StateFile))
+			}
+			stateFiles[r.StateFile] = true
+		}
+
+		if r.Timeouts.Clone < 0 || r.Timeouts.Fetch < 0 || r.Timeouts.Checkout < 0 {
+			errs = append(errs, f.errorf(r, "timeouts", "repos[%d]: timeouts must not be negative", i))
+		}
+		if r.Retry.InitialBackoff < 0 || r.Retry.MaxBackoff < 0 || r.Retry.CircuitOpenDuration < 0 {
+			errs = append(errs, f.errorf(r, "retry", "repos[%d]: retry durations must not be negative", i))
+		}
+		if r.Retry.Jitter > 1 {
+			errs = append(errs, f.errorf(r, "retry", "repos[%d]: retry.jitter must not be greater than 1", i))
+		}
+
+		for _, phase := range []struct {
+			name  string
+			hooks []Hook
+		}{{"preSync", r.Hooks.PreSync}, {"postSync", r.Hooks.PostSync}} {
+			for j, hook := range phase.hooks {
+				if len(hook.Command) == 0 {
+					errs = append(errs, f.errorf(r, "hooks", "repos[%d]: hooks.%s[%d]: command is required", i, phase.name, j))
+				}
+				if hook.Timeout < 0 {
+					errs = append(errs, f.errorf(r, "hooks", "repos[%d]: hooks.%s[%d]: timeout must not be negative", i, phase.name, j))
+				}
+			}
+		}
+
+		for j, n := range r.Notifications {
+			errs = append(errs, f.validateNotification(r, fmt.Sprintf("repos[%d]: notifications[%d]", i, j), n)...)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (f *File) validateNotification(r *Repo, prefix string, n Notification) []error {
+	var errs []error
+
+	if u, err := url.Parse(n.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, f.errorf(r, "notifications", "%s: url must be an absolute http or https url", prefix))
+	}
+	for _, event := range n.Events {
+		if !slices.Contains(syncer.Events, event) {
+			errs = append(errs, f.errorf(r, "notifications", "%s: unknown event %q, expected one of %s", prefix, event, strings.Join(syncer.Events, ", ")))
+		}
+	}
+	if n.Template != "" {
+		if _, err := syncer.ParseNotificationTemplate(n.Template); err != nil {
+			errs = append(errs, f.errorf(r, "notifications", "%s: invalid template: %v", prefix, err))
+		}
+	}
+	if n.Timeout < 0 || n.Backoff < 0 || n.MaxAttempts < 0 {
+		errs = append(errs, f.errorf(r, "notifications", "%s: timeout, backoff and maxAttempts must not be negative", prefix))
+	}
+	return errs
+}
+
+// errorf builds an Error pointing at key in the repo, at the repo itself when
+// the key is missing, or at no line at all when the repo was not read from
+// the file.
+func (f *File) errorf(r *Repo, key string, format string, args ...any) error {
+	line := 0
+	if r != nil && r.node != nil {
+		line = r.node.Line
+		if v := mappingKey(r.node, key); v != nil {
+			line = v.Line
+		}
+	}
+	return &Error{File: f.name, Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// RefName returns the reference to track. Ref takes precedence over Branch.
+func (r *Repo) RefName() plumbing.ReferenceName {
+	if r.Ref != "" {
+		return plumbing.ReferenceName(r.Ref)
+	}
+
+	branch := r.Branch
+	if branch == "" {
+		branch = DefaultBranch
+	}
+	return plumbing.NewBranchReferenceName(branch)
+}
+
+func (r *Repo) SyncOptions() syncer.SyncOptions {
+	return syncer.SyncOptions{
+		Path:         r.Path,
+		RefName:      r.RefName(),
+		CABuntleFile: r.CABundleFile,
+		PollInterval: r.PollInterval,
+		Auth:         syncAuth(r.URL, r.Auth),
+		Publish: syncer.PublishOptions{
+			Root:          r.Publish.Root,
+			KeepRevisions: r.Publish.KeepRevisions,
+		},
+		Hooks: syncer.HookOptions{
+			PreSync:  syncHooks(r.Hooks.PreSync),
+			PostSync: syncHooks(r.Hooks.PostSync),
+		},
+		Notifications:     syncNotifications(r.Notifications),
+		IncludePrerelease: r.IncludePrerelease,
+		Timeouts: syncer.Timeouts{
+			Clone:    r.Timeouts.Clone,
+			Fetch:    r.Timeouts.Fetch,
+			Checkout: r.Timeouts.Checkout,
+		},
+		QuarantineDir:  r.QuarantineDir,
+		QuarantineKeep: r.QuarantineKeep,
+		StateFile:      r.StateFile,
+		Depth:          r.Depth,
+		Filter:         r.Filter,
+		Sparse: syncer.SparseOptions{
+			Include: r.Sparse.Include,
+			Exclude: r.Sparse.Exclude,
+		},
+		Submodules: syncer.SubmoduleOptions{
+			Enabled:     r.Submodules.Enabled,
+			MaxDepth:    r.Submodules.MaxDepth,
+			AllowedURLs: r.Submodules.AllowedURLs,
+			Auth:        submoduleAuth(r.Submodules.Auth),
+		},
+		LFS: syncer.LFSOptions{
+			Enabled:  r.LFS.Enabled,
+			URL:      r.LFS.URL,
+			Include:  r.LFS.Include,
+			Exclude:  r.LFS.Exclude,
+			CacheDir: r.LFS.CacheDir,
+		},
+		Retry: syncer.RetryPolicy{
+			InitialBackoff:       r.Retry.InitialBackoff,
+			MaxBackoff:           r.Retry.MaxBackoff,
+			Jitter:               r.Retry.Jitter,
+			AuthFailureThreshold: r.Retry.AuthFailureThreshold,
+			CircuitOpenDuration:  r.Retry.CircuitOpenDuration,
+		},
+		History: syncer.HistoryOptions{
+			Limit:   r.History.Limit,
+			Persist: r.History.Persist,
+		},
+	}
+}
+
+func syncAuth(url string, a Auth) syncer.AuthOptions {
+	return syncer.AuthOptions{
+		Repo:              url,
+		Username:          a.Username,
+		Password:          a.Password,
+		PasswordFile:      a.PasswordFile,
+		SSHPrivateKeyFile: a.SSHPrivateKeyFile,
+		InsecureSkipTLS:   a.InsecureSkipTLS,
+		KnownHostsFile:    a.KnownHostsFile,
+	}
+}
+
+func submoduleAuth(auth map[string]Auth) map[string]syncer.AuthOptions {
+	if len(auth) == 0 {
+		return nil
+	}
+
+	out := make(map[string]syncer.AuthOptions, len(auth))
+	for p, a := range auth {
+		out[path.Clean(p)] = syncAuth("", a)
+	}
+	return out
+}
+
+func syncNotifications(notifications []Notification) []syncer.Notification {
+	if len(notifications) == 0 {
+		return nil
+	}
+
+	out := make([]syncer.Notification, 0, len(notifications))
+	for _, n := range notifications {
+		out = append(out, syncer.Notification{
+			Name:        n.Name,
+			URL:         n.URL,
+			Secret:      n.Secret,
+			SecretFile:  n.SecretFile,
+			Events:      n.Events,
+			Template:    n.Template,
+			Timeout:     n.Timeout,
+			MaxAttempts: n.MaxAttempts,
+			Backoff:     n.Backoff,
+		})
+	}
+	return out
+}
+
+func syncHooks(hooks []Hook) []syncer.Hook {
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	out := make([]syncer.Hook, 0, len(hooks))
+	for _, hook := range hooks {
+		out = append(out, syncer.Hook{Name: hook.Name, Command: hook.Command, Timeout: hook.Timeout})
+	}
+	return out
+}
+
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${NAME} references in every scalar below node.
+func expandEnv(file string, node *yaml.Node) []error {
+	var errs []error
+
+	if node.Kind == yaml.ScalarNode {
+		node.Value = envRef.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			name := envRef.FindStringSubmatch(ref)[1]
+			val, ok := os.LookupEnv(name)
+			if !ok {
+				errs = append(errs, &Error{File: file, Line: node.Line, Msg: fmt.Sprintf("environment variable %s is not set", name)})
+			}
+			return val
+		})
+		return errs
+	}
+
+	for _, child := range node.Content {
+		errs = append(errs, expandEnv(file, child)...)
+	}
+	return errs
+}
+
+// checkKeys reports every mapping key below node that has no matching yaml
+// field in t.
+func checkKeys(file string, node *yaml.Node, t reflect.Type) []error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	var errs []error
+	switch {
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			errs = append(errs, checkKeys(file, item, t.Elem())...)
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			errs = append(errs, checkKeys(file, node.Content[i], t.Elem())...)
+		}
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := map[string]reflect.Type{}
+		for i := range t.NumField() {
+			field := t.Field(i)
+			if tag, _, _ := strings.Cut(field.Tag.Get("yaml"), ","); tag != "" && tag != "-" {
+				fields[tag] = field.Type
+			}
+		}
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			fieldType, ok := fields[key.Value]
+			if !ok {
+				errs = append(errs, &Error{File: file, Line: key.Line, Msg: fmt.Sprintf("unknown field %q", key.Value)})
+				continue
+			}
+			errs = append(errs, checkKeys(file, value, fieldType)...)
+		}
+	}
+	return errs
+}
+
+// decodeError converts the "line N: msg" entries of a yaml.TypeError into
+// Errors.
+func decodeError(file string, err error) error {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) {
+		return &Error{File: file, Msg: err.Error()}
+	}
+
+	errs := make([]error, 0, len(typeErr.Errors))
+	for _, msg := range typeErr.Errors {
+		e := &Error{File: file, Msg: msg}
+		if rest, ok := strings.CutPrefix(msg, "line "); ok {
+			if num, text, ok := strings.Cut(rest, ": "); ok {
+				if line, err := strconv.Atoi(num); err == nil {
+					e.Line, e.Msg = line, text
+				}
+			}
+		}
+		errs = append(errs, e)
+	}
+	return errors.Join(errs...)
+}
+
+func mappingKey(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i]
+		}
+	}
+	return nil
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,139 @@
+package configfile
+
+import (
+	"testing"
+	"time"
+
+	"github.com/clbiggs/git-sync/pkg/git/syncer"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	t.Setenv("TEST_GIT_TOKEN", "s3cret")
+
+	file, err := Parse("config.yaml", []byte(`
+server:
+  address: ":9090"
+  maxConcurrentSyncs: 2
+repos:
+  - name: app
+    url: https://example.com/app.git
+    path: /data/app
+    branch: release
+    pollInterval: 1m
+    auth:
+      username: git
+      password: ${TEST_GIT_TOKEN}
+    timeouts:
+      fetch: 30s
+    retry:
+      jitter: 0.2
+      authFailureThreshold: -1
+  - name: docs
+    url: https://example.com/docs.git
+    path: /data/docs
+    ref: refs/tags/v1.0.0
+    pollInterval: 5m
+    hooks:
+      postSync:
+        - name: reload
+          command: [nginx, -s, reload]
+          timeout: 10s
+    notifications:
+      - url: https://hooks.example.com/deploy
+        secret: ${TEST_GIT_TOKEN}
+        events: [ref.changed]
+`))
+	require.NoError(t, err)
+	require.NoError(t, file.Validate())
+
+	assert.Equal(t, ":9090", file.Server.Address)
+	assert.Equal(t, 2, file.Server.MaxConcurrentSyncs)
+	require.Len(t, file.Repos, 2)
+
+	opts := file.Repos[0].SyncOptions()
+	assert.Equal(t, plumbing.ReferenceName("refs/heads/release"), opts.RefName)
+	assert.Equal(t, time.Minute, opts.PollInterval)
+	assert.Equal(t, "s3cret", opts.Auth.Password)
+	assert.Equal(t, syncer.Timeouts{Fetch: 30 * time.Second}, opts.Timeouts)
+	assert.Equal(t, syncer.RetryPolicy{Jitter: 0.2, AuthFailureThreshold: -1}, opts.Retry)
+	assert.Equal(t, plumbing.ReferenceName("refs/tags/v1.0.0"), file.Repos[1].RefName())
+	assert.Equal(t, []syncer.Hook{{Name: "reload", Command: []string{"nginx", "-s", "reload"}, Timeout: 10 * time.Second}},
+		file.Repos[1].SyncOptions().Hooks.PostSync)
+	assert.Equal(t, []syncer.Notification{{URL: "https://hooks.example.com/deploy", Secret: "s3cret", Events: []string{syncer.EventRefChanged}}},
+		file.Repos[1].SyncOptions().Notifications)
+}
+
+func TestParseErrors(t *testing.T) {
+	_, err := Parse("config.yaml", []byte(`
+repos:
+  - name: app
+    url: ${TEST_UNDEFINED_VARIABLE}
+    paht: /data/app
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "config.yaml:4: environment variable TEST_UNDEFINED_VARIABLE is not set")
+	assert.Contains(t, err.Error(), `config.yaml:5: unknown field "paht"`)
+
+	// Keys below map values are checked as well.
+	_, err = Parse("config.yaml", []byte(`
+repos:
+  - name: app
+    submodules:
+      auth:
+        vendor/shared:
+          pasword: s3cret
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `config.yaml:7: unknown field "pasword"`)
+
+	_, err = Parse("config.yaml", []byte(`
+repos:
+  - name: app
+    pollInterval: soon
+`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "config.yaml:4: cannot unmarshal")
+}
+
+func TestValidate(t *testing.T) {
+	file, err := Parse("config.yaml", []byte(`
+repos:
+  - name: app
+    url: https://example.com/app.git
+    path: /data/app
+    pollInterval: 1m
+    stateFile: /state/app.json
+  - name: app
+    path: /data/app
+    ref: "semver:not a constraint"
+    pollInterval: 1m
+    hooks:
+      preSync:
+        - name: empty
+    notifications:
+      - url: /relative
+        events: [sync.started]
+        template: "{{ .Missing"
+    quarantineDir: /data/app/.quarantine
+    stateFile: /state/app.json
+    filter: tree:0
+`))
+	require.NoError(t, err)
+
+	err = file.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), `config.yaml:8: repos[1]: duplicate name "app"`)
+	assert.Contains(t, err.Error(), "config.yaml:8: repos[1]: url is required")
+	assert.Contains(t, err.Error(), `config.yaml:9: repos[1]: path "/data/app" is used by another repo`)
+	assert.Contains(t, err.Error(), `config.yaml:10: repos[1]: invalid semver constraint "not a constraint"`)
+	assert.Contains(t, err.Error(), "config.yaml:12: repos[1]: hooks.preSync[0]: command is required")
+	assert.Contains(t, err.Error(), "config.yaml:15: repos[1]: notifications[0]: url must be an absolute http or https url")
+	assert.Contains(t, err.Error(), `config.yaml:15: repos[1]: notifications[0]: unknown event "sync.started"`)
+	assert.Contains(t, err.Error(), "config.yaml:15: repos[1]: notifications[0]: invalid template")
+	assert.Contains(t, err.Error(), "config.yaml:19: repos[1]: quarantineDir must be outside of path")
+	assert.Contains(t, err.Error(), `config.yaml:20: repos[1]: stateFile "/state/app.json" is used by another repo`)
+	assert.Contains(t, err.Error(), `config.yaml:21: repos[1]: unsupported filter "tree:0"`)
+}
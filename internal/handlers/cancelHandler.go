@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/clbiggs/git-sync/pkg/git/syncer"
+)
+
+func CancelHandler(manager *syncer.Manager, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		sync, ok := syncerNamed(manager, name, w)
+		if !ok {
+			return
+		}
+		cancelSync(w, sync)
+	}
+}
+
+func RepoCancelHandler(manager *syncer.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sync, ok := syncerFromRequest(manager, w, r)
+		if !ok {
+			return
+		}
+		cancelSync(w, sync)
+	}
+}
+
+func cancelSync(w http.ResponseWriter, sync *syncer.Syncer) {
+	log.Println("Cancel requested")
+	writeSyncResult(w, sync, sync.Cancel())
+}
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/clbiggs/git-sync/pkg/git/syncer"
+)
+
+const (
+	defaultHistoryLimit = 20
+	maxHistoryLimit     = 100
+)
+
+type historyPage struct {
+	Total   int                   `json:"total"`
+	Offset  int                   `json:"offset"`
+	Limit   int                   `json:"limit"`
+	Entries []syncer.HistoryEntry `json:"entries"`
+}
+
+func HistoryHandler(manager *syncer.Manager, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sync, ok := syncerNamed(manager, name, w)
+		if !ok {
+			return
+		}
+		writeHistory(w, r, sync)
+	}
+}
+
+func RepoHistoryHandler(manager *syncer.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sync, ok := syncerFromRequest(manager, w, r)
+		if !ok {
+			return
+		}
+		writeHistory(w, r, sync)
+	}
+}
+
+// writeHistory writes the page of the history, newest first, selected by the
+// offset and limit query parameters.
+func writeHistory(w http.ResponseWriter, r *http.Request, sync *syncer.Syncer) {
+	offset, ok := queryInt(w, r, "offset", 0, 0)
+	if !ok {
+		return
+	}
+	limit, ok := queryInt(w, r, "limit", defaultHistoryLimit, 1)
+	if !ok {
+		return
+	}
+	limit = min(limit, maxHistoryLimit)
+
+	history := sync.History()
+	slices.Reverse(history)
+	page := historyPage{Total: len(history), Offset: offset, Limit: limit, Entries: []syncer.HistoryEntry{}}
+	if offset < len(history) {
+		page.Entries = history[offset:min(offset+limit, len(history))]
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(page)
+}
+
+// queryInt parses the query parameter, which must be at least minimum, and
+// writes a 400 response if it is invalid.
+func queryInt(w http.ResponseWriter, r *http.Request, name string, def int, minimum int) (int, bool) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return def, true
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < minimum {
+		http.Error(w, "Invalid "+name+": "+value, http.StatusBadRequest)
+		return 0, false
+	}
+	return n, true
+}
@@ -0,0 +1,84 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/clbiggs/git-sync/pkg/git/syncer"
+)
+
+type pinRequest struct {
+	// Commit is the hash to pin. When empty, Previous must be set.
+	Commit string `json:"commit"`
+	// Previous pins the commit synced before the current one.
+	Previous bool `json:"previous"`
+}
+
+func PinHandler(manager *syncer.Manager, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sync, ok := syncerNamed(manager, name, w)
+		if !ok {
+			return
+		}
+		pin(w, r, sync)
+	}
+}
+
+func RepoPinHandler(manager *syncer.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sync, ok := syncerFromRequest(manager, w, r)
+		if !ok {
+			return
+		}
+		pin(w, r, sync)
+	}
+}
+
+func UnpinHandler(manager *syncer.Manager, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		sync, ok := syncerNamed(manager, name, w)
+		if !ok {
+			return
+		}
+		unpin(w, sync)
+	}
+}
+
+func RepoUnpinHandler(manager *syncer.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sync, ok := syncerFromRequest(manager, w, r)
+		if !ok {
+			return
+		}
+		unpin(w, sync)
+	}
+}
+
+func pin(w http.ResponseWriter, r *http.Request, sync *syncer.Syncer) {
+	var req pinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Commit == "" && !req.Previous {
+		http.Error(w, "Either commit or previous is required", http.StatusBadRequest)
+		return
+	}
+
+	var err error
+	if req.Previous {
+		log.Println("Pin requested: previous commit")
+		err = sync.PinPrevious()
+	} else {
+		log.Printf("Pin requested: %s", req.Commit)
+		err = sync.Pin(req.Commit)
+	}
+
+	writeSyncResult(w, sync, err)
+}
+
+func unpin(w http.ResponseWriter, sync *syncer.Syncer) {
+	log.Println("Unpin requested")
+	writeSyncResult(w, sync, sync.Unpin())
+}
@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/clbiggs/git-sync/pkg/git/syncer"
+)
+
+type readiness struct {
+	Status string            `json:"status"`
+	Repos  map[string]string `json:"repos"`
+}
+
+// ReadinessHandler reports the health of every repository. It responds with
+// 503 until every repository has a worktree and with 200 otherwise, also
+// while serving the worktree of an earlier sync because syncs fail.
+func ReadinessHandler(manager *syncer.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		result := readiness{Status: syncer.HealthOK, Repos: map[string]string{}}
+		for name, status := range manager.Statuses() {
+			health := status.Health()
+			result.Repos[name] = health
+
+			switch {
+			case health == syncer.HealthUnavailable:
+				result.Status = health
+			case health == syncer.HealthDegraded && result.Status == syncer.HealthOK:
+				result.Status = health
+			}
+		}
+
+		code := http.StatusOK
+		if result.Status == syncer.HealthUnavailable {
+			code = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(code)
+		_ = json.NewEncoder(w).Encode(result)
+	}
+}
@@ -0,0 +1,36 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/clbiggs/git-sync/pkg/git/syncer"
+	"github.com/gorilla/mux"
+)
+
+// ReposHandler returns the status of every repository keyed by name.
+func ReposHandler(manager *syncer.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		_ = json.NewEncoder(w).Encode(manager.Statuses())
+	}
+}
+
+// syncerFromRequest looks up the syncer named by the {name} route variable and
+// writes a 404 response if it does not exist.
+func syncerFromRequest(manager *syncer.Manager, w http.ResponseWriter, r *http.Request) (*syncer.Syncer, bool) {
+	return syncerNamed(manager, mux.Vars(r)["name"], w)
+}
+
+// syncerNamed looks up the syncer on every request, so that a repo removed by
+// a configuration reload is not served, and writes a 404 response if it does
+// not exist.
+func syncerNamed(manager *syncer.Manager, name string, w http.ResponseWriter) (*syncer.Syncer, bool) {
+	sync, ok := manager.Get(name)
+	if !ok {
+		http.Error(w, "Repository not found: "+name, http.StatusNotFound)
+		return nil, false
+	}
+	return sync, true
+}
@@ -7,10 +7,28 @@ import (
 	"github.com/clbiggs/git-sync/pkg/git/syncer"
 )
 
-func StatusHandler(sync *syncer.Syncer) http.HandlerFunc {
+func StatusHandler(manager *syncer.Manager, name string) http.HandlerFunc {
 	return func(w http.ResponseWriter, _ *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(w).Encode(sync.Status())
+		sync, ok := syncerNamed(manager, name, w)
+		if !ok {
+			return
+		}
+		writeStatus(w, sync)
 	}
 }
+
+func RepoStatusHandler(manager *syncer.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sync, ok := syncerFromRequest(manager, w, r)
+		if !ok {
+			return
+		}
+		writeStatus(w, sync)
+	}
+}
+
+func writeStatus(w http.ResponseWriter, sync *syncer.Syncer) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(sync.Status())
+}
@@ -1,30 +1,80 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"log"
 	"net/http"
 
 	"github.com/clbiggs/git-sync/pkg/git/syncer"
 )
 
-func WebhookHandler(sync *syncer.Syncer) http.HandlerFunc {
-	return func(w http.ResponseWriter, _ *http.Request) {
-		log.Println("Webhook triggered: forcing pull")
-		err := sync.ForceSync()
-		if err != nil {
-			details := map[string]any{
-				"error":  err.Error(),
-				"status": sync.Status(),
-			}
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusInternalServerError)
-			_ = json.NewEncoder(w).Encode(details)
+func WebhookHandler(manager *syncer.Manager, name string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sync, ok := syncerNamed(manager, name, w)
+		if !ok {
 			return
 		}
+		forceSync(w, r, sync)
+	}
+}
+
+func RepoWebhookHandler(manager *syncer.Manager) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		sync, ok := syncerFromRequest(manager, w, r)
+		if !ok {
+			return
+		}
+		forceSync(w, r, sync)
+	}
+}
+
+// forceSync waits for the sync as long as the client does. The sync is
+// canceled if no other caller waits for it.
+func forceSync(w http.ResponseWriter, r *http.Request, sync *syncer.Syncer) {
+	log.Println("Webhook triggered: forcing pull")
+	writeSyncResult(w, sync, sync.ForceSyncContext(r.Context()))
+}
+
+// writeSyncResult writes the status of the syncer, along with the error of a
+// failed operation.
+func writeSyncResult(w http.ResponseWriter, sync *syncer.Syncer, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		details := map[string]any{
+			"error":  err.Error(),
+			"status": sync.Status(),
+		}
+		w.WriteHeader(errorStatusCode(err))
+		_ = json.NewEncoder(w).Encode(details)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	_ = json.NewEncoder(w).Encode(sync.Status())
+}
 
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(w).Encode(sync.Status())
+// errorStatusCode maps the class of an error to an http status code.
+func errorStatusCode(err error) int {
+	switch {
+	case errors.Is(err, syncer.ErrInvalidHash):
+		return http.StatusBadRequest
+	case errors.Is(err, syncer.ErrNoPreviousCommit), errors.Is(err, syncer.ErrCommitNotFound),
+		errors.Is(err, syncer.ErrSyncCanceled), errors.Is(err, syncer.ErrNoSyncInProgress):
+		return http.StatusConflict
+	case errors.Is(err, syncer.ErrSyncerClosed):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, syncer.ErrRefNotFound), errors.Is(err, syncer.ErrSubmoduleNotAllowed):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, syncer.ErrAuthentication), errors.Is(err, syncer.ErrHostKeyMismatch),
+		errors.Is(err, syncer.ErrNetworkUnreachable):
+		return http.StatusBadGateway
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, syncer.ErrDiskFull):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
 	}
 }
@@ -0,0 +1,483 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// fileCheck is how checkoutEntry tells whether a file in the worktree is up
+// to date.
+type fileCheck int
+
+const (
+	// checkStat takes a file whose stat info matches the index entry as up
+	// to date, and compares the content of the others.
+	checkStat fileCheck = iota
+	// checkContent compares the content of the file.
+	checkContent
+	// checkNone writes the file, its content is known to differ.
+	checkNone
+)
+
+// worktreeState is the commit and the options the worktree was last checked
+// out with.
+type worktreeState struct {
+	commit plumbing.Hash
+	sparse SparseOptions
+	lfs    LFSOptions
+	// lfsFiles are the pointer files checked out with their LFS object.
+	lfsFiles *lfsFiles
+}
+
+// worktreeCheckout writes the files of a commit into the worktree and keeps
+// the index in step with them.
+type worktreeCheckout struct {
+	repo   *git.Repository
+	root   string
+	idx    *index.Index
+	sparse SparseOptions
+	lfs    *lfsFiles
+	// written and removed count the files changed in the worktree.
+	written int
+	removed int
+}
+
+// checkoutWorktree brings the worktree, the index and HEAD to the commit,
+// checking out only the paths selected by SyncOptions.Sparse and LFS objects
+// instead of their pointers. The other files are marked skip-worktree in the
+// index, like git sparse-checkout does, and removed from the worktree.
+//
+// Only the files that differ between the commit the worktree was last checked
+// out at and the new one are written, removed or have their mode changed.
+// For the same commit only the files whose stat info no longer matches the
+// index are compared with it. The first checkout of a Syncer, one with other
+// sparse or LFS options, and one with LFS and changed .gitattributes files
+// compares every file.
+//
+// ctx stops the downloads before the checkout. Once the first file is
+// written the checkout is completed, even if ctx is done.
+func (s *Syncer) checkoutWorktree(ctx context.Context, repo *git.Repository, hash plumbing.Hash) error {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrCommitNotFound, hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	state := &worktreeState{commit: hash, sparse: s.Options.Sparse, lfs: s.Options.LFS}
+	from := s.checkedOutTree(repo, state)
+
+	// The blobs and LFS objects are downloaded before anything changes on
+	// disk.
+	if err = s.fetchMissingBlobs(ctx, repo, from, tree); err != nil {
+		return err
+	}
+	var last *lfsFiles
+	if from != nil {
+		last = s.worktree.lfsFiles
+	}
+	lfs, err := s.prepareLFS(ctx, tree, from, last)
+	if err != nil {
+		return err
+	}
+	state.lfsFiles = lfs
+	// Changed .gitattributes files, which prepareLFS reads again, can turn
+	// unchanged files into pointer files or back, so every file is compared.
+	if last != nil && lfs.attributes != last.attributes {
+		from = nil
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return classified(ErrWorktreeCorrupt, fmt.Errorf("failed to get worktree: %w", err))
+	}
+	idx, err := repo.Storer.Index()
+	if err != nil {
+		return classified(ErrWorktreeCorrupt, fmt.Errorf("failed to read index: %w", err))
+	}
+	c := &worktreeCheckout{repo: repo, root: w.Filesystem.Root(), idx: idx, sparse: s.Options.Sparse, lfs: lfs}
+
+	// A checkout that started is completed, so that a canceled sync does not
+	// leave the worktree between the commits.
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	ctx = context.WithoutCancel(ctx)
+
+	// A failed checkout leaves the worktree somewhere between the commits,
+	// so the next one compares every file.
+	s.worktree = nil
+	switch {
+	case from == nil:
+		err = c.full(tree)
+	case from.Hash == tree.Hash:
+		err = c.drift()
+	default:
+		err = c.update(ctx, from, tree)
+	}
+	if err != nil {
+		return err
+	}
+
+	// git reads the skip-worktree flags from index version 3 on.
+	if idx.Version < 3 && slices.ContainsFunc(idx.Entries, func(e *index.Entry) bool { return e.SkipWorktree }) {
+		idx.Version = 3
+	}
+	if err = setHEAD(repo, hash); err != nil {
+		return err
+	}
+	if err = repo.Storer.SetIndex(idx); err != nil {
+		return err
+	}
+	s.worktree = state
+
+	if c.written > 0 || c.removed > 0 {
+		log.Printf("Wrote %d and removed %d files in the worktree.", c.written, c.removed)
+	}
+	return nil
+}
+
+// checkedOutTree returns the tree the worktree was last checked out at, or
+// nil if it was not checked out by this Syncer with the options of state.
+func (s *Syncer) checkedOutTree(repo *git.Repository, state *worktreeState) *object.Tree {
+	last := s.worktree
+	if last == nil || !reflect.DeepEqual(last.sparse, state.sparse) || !reflect.DeepEqual(last.lfs, state.lfs) {
+		return nil
+	}
+	commit, err := repo.CommitObject(last.commit)
+	if err != nil {
+		return nil
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil
+	}
+	return tree
+}
+
+// update applies the changes between the trees to the worktree and the
+// index, which holds the from tree.
+func (c *worktreeCheckout) update(ctx context.Context, from *object.Tree, to *object.Tree) error {
+	changes, err := object.DiffTreeWithOptions(ctx, from, to, nil)
+	if err != nil {
+		return err
+	}
+
+	// Nothing changes on disk for a tree with an unsafe path.
+	for _, change := range changes {
+		for _, name := range []string{change.From.Name, change.To.Name} {
+			if name == "" {
+				continue
+			}
+			if err = checkPath(name); err != nil {
+				return err
+			}
+		}
+	}
+
+	entries := make(map[string]*index.Entry, len(c.idx.Entries))
+	for _, e := range c.idx.Entries {
+		entries[e.Name] = e
+	}
+
+	// Deleted files go first, so that a file can replace a directory.
+	removed := map[string]bool{}
+	for _, change := range changes {
+		if change.To.Name != "" {
+			continue
+		}
+		e, ok := entries[change.From.Name]
+		if !ok {
+			continue
+		}
+		delete(entries, e.Name)
+		removed[e.Name] = true
+		if !e.SkipWorktree {
+			if err = c.remove(e.Name); err != nil {
+				return err
+			}
+		}
+	}
+	c.idx.Entries = slices.DeleteFunc(c.idx.Entries, func(e *index.Entry) bool {
+		return removed[e.Name]
+	})
+
+	for _, change := range changes {
+		if change.To.Name == "" {
+			continue
+		}
+
+		e, ok := entries[change.To.Name]
+		if !ok {
+			e = c.idx.Add(change.To.Name)
+		}
+		// A changed file is written without reading it first, unless only
+		// its mode changed. A new one may be in the worktree already.
+		check := checkNone
+		if !ok || change.From.TreeEntry.Hash == change.To.TreeEntry.Hash {
+			check = checkContent
+		}
+		*e = index.Entry{
+			Name:         change.To.Name,
+			Hash:         change.To.TreeEntry.Hash,
+			Mode:         change.To.TreeEntry.Mode,
+			SkipWorktree: !c.sparse.match(change.To.Name),
+		}
+		if e.SkipWorktree {
+			continue
+		}
+		if err = c.checkoutEntry(e, check); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// full checks out every file of the tree, comparing the content of the files
+// that are in the worktree already, and replaces the index with the tree.
+func (c *worktreeCheckout) full(tree *object.Tree) error {
+	old := make(map[string]*index.Entry, len(c.idx.Entries))
+	for _, e := range c.idx.Entries {
+		old[e.Name] = e
+	}
+
+	var entries []*index.Entry
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if entry.Mode == filemode.Dir {
+			continue
+		}
+		if err = checkPath(name); err != nil {
+			return err
+		}
+		entries = append(entries, &index.Entry{
+			Name:         name,
+			Hash:         entry.Hash,
+			Mode:         entry.Mode,
+			SkipWorktree: !c.sparse.match(name),
+		})
+	}
+
+	// Files that left the tree or the sparse checkout go first, so that a
+	// file can replace a directory.
+	for _, e := range entries {
+		prev, ok := old[e.Name]
+		if !ok {
+			continue
+		}
+		delete(old, e.Name)
+		if e.SkipWorktree && !prev.SkipWorktree {
+			if err := c.remove(e.Name); err != nil {
+				return err
+			}
+		}
+	}
+	for name, prev := range old {
+		if prev.SkipWorktree {
+			continue
+		}
+		if err := c.remove(name); err != nil {
+			return err
+		}
+	}
+
+	for _, e := range entries {
+		if e.SkipWorktree {
+			continue
+		}
+		if err := c.checkoutEntry(e, checkContent); err != nil {
+			return err
+		}
+	}
+	c.idx.Entries = entries
+	return nil
+}
+
+// drift restores the files changed in the worktree since the index was
+// written. Files whose stat info matches the index are not read.
+func (c *worktreeCheckout) drift() error {
+	for _, e := range c.idx.Entries {
+		if e.SkipWorktree {
+			continue
+		}
+		if err := c.checkoutEntry(e, checkStat); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkoutEntry writes the file of the index entry below root, unless it is
+// there already, and records its stat info in the entry.
+func (c *worktreeCheckout) checkoutEntry(e *index.Entry, check fileCheck) error {
+	// The index may be older than the checks of the trees.
+	if err := checkPath(e.Name); err != nil {
+		return err
+	}
+
+	target := filepath.Join(c.root, filepath.FromSlash(e.Name))
+	if e.Mode == filemode.Submodule {
+		//nolint:gosec // the worktree is read by other processes
+		return os.MkdirAll(target, 0o755)
+	}
+
+	if info, err := os.Lstat(target); err == nil && check != checkNone {
+		if check == checkStat && statMatches(e, info) {
+			return nil
+		}
+		if c.contentMatches(target, e, info) {
+			if e.Mode.IsRegular() && isExecutable(info) != (e.Mode == filemode.Executable) {
+				if err = os.Chmod(target, filePerm(e.Mode)); err != nil {
+					return err
+				}
+				c.written++
+			}
+			return recordStat(e, target)
+		}
+	}
+
+	blob, err := c.repo.BlobObject(e.Hash)
+	if err != nil {
+		return err
+	}
+	if err = os.RemoveAll(target); err != nil {
+		return err
+	}
+	if err = writeFile(object.NewFile(e.Name, e.Mode, blob), c.root, c.lfs); err != nil {
+		return err
+	}
+	c.written++
+	return recordStat(e, target)
+}
+
+// contentMatches reports whether the file at target has the content of the
+// index entry, or of the LFS object for a pointer file. The mode of regular
+// files is not compared.
+func (c *worktreeCheckout) contentMatches(target string, e *index.Entry, info os.FileInfo) bool {
+	if p, ok := c.lfs.pointer(e.Name); ok {
+		return info.Mode().IsRegular() && info.Size() == p.Size && c.lfs.matches(target, p)
+	}
+
+	switch {
+	case e.Mode == filemode.Symlink && info.Mode()&os.ModeSymlink != 0:
+		link, err := os.Readlink(target)
+		return err == nil && plumbing.ComputeHash(plumbing.BlobObject, []byte(link)) == e.Hash
+	case e.Mode.IsRegular() && info.Mode().IsRegular():
+		//nolint:gosec // the path is below the worktree
+		f, err := os.Open(target)
+		if err != nil {
+			return false
+		}
+		defer f.Close()
+
+		h := plumbing.NewHasher(plumbing.BlobObject, info.Size())
+		if _, err = io.Copy(h, f); err != nil {
+			return false
+		}
+		return h.Sum() == e.Hash
+	default:
+		return false
+	}
+}
+
+// remove removes the file of the index entry from the worktree.
+func (c *worktreeCheckout) remove(name string) error {
+	if err := removeWorktreeFile(c.root, name); err != nil {
+		return err
+	}
+	c.removed++
+	return nil
+}
+
+// statMatches reports whether the file has the type, size and modification
+// time recorded in the index entry. Like for git, a change that keeps all of
+// them goes unnoticed.
+func statMatches(e *index.Entry, info os.FileInfo) bool {
+	switch {
+	case e.Mode == filemode.Symlink:
+		if info.Mode()&os.ModeSymlink == 0 {
+			return false
+		}
+	case e.Mode.IsRegular():
+		if !info.Mode().IsRegular() || isExecutable(info) != (e.Mode == filemode.Executable) {
+			return false
+		}
+	default:
+		return false
+	}
+	//nolint:gosec // the index keeps the size modulo 2^32, like git does
+	return !e.ModifiedAt.IsZero() && e.ModifiedAt.Equal(info.ModTime()) && e.Size == uint32(info.Size())
+}
+
+// recordStat records the size and modification time of the file at target
+// in the index entry.
+func recordStat(e *index.Entry, target string) error {
+	info, err := os.Lstat(target)
+	if err != nil {
+		return err
+	}
+	e.ModifiedAt = info.ModTime()
+	//nolint:gosec // the index keeps the size modulo 2^32, like git does
+	e.Size = uint32(info.Size())
+	return nil
+}
+
+func isExecutable(info os.FileInfo) bool {
+	return info.Mode()&0o100 != 0
+}
+
+// setHEAD points HEAD, or the branch it refers to, at the commit.
+func setHEAD(repo *git.Repository, hash plumbing.Hash) error {
+	head, err := repo.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		return err
+	}
+	name := plumbing.HEAD
+	if head.Type() == plumbing.SymbolicReference {
+		name = head.Target()
+	}
+	return repo.Storer.SetReference(plumbing.NewHashReference(name, hash))
+}
+
+// removeWorktreeFile removes the file, or the worktree of a submodule, below
+// root and the directories it leaves empty.
+func removeWorktreeFile(root string, name string) error {
+	if err := checkPath(name); err != nil {
+		return err
+	}
+
+	target := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.RemoveAll(target); err != nil {
+		return err
+	}
+
+	for dir := filepath.Dir(target); dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,275 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/require"
+)
+
+// Chmod changes the permissions of the files of the remote and commits them,
+// returning the new commit hash.
+func (r *testRemote) Chmod(perm os.FileMode, names ...string) string {
+	r.t.Helper()
+
+	w, err := r.repo.Worktree()
+	require.NoError(r.t, err)
+	for _, name := range names {
+		require.NoError(r.t, os.Chmod(filepath.Join(r.Path, name), perm))
+		_, err = w.Add(name)
+		require.NoError(r.t, err)
+	}
+	return r.Commit(nil)
+}
+
+// Remove removes the files from the remote and commits it, returning the new
+// commit hash.
+func (r *testRemote) Remove(names ...string) string {
+	r.t.Helper()
+
+	w, err := r.repo.Worktree()
+	require.NoError(r.t, err)
+	for _, name := range names {
+		_, err = w.Remove(name)
+		require.NoError(r.t, err)
+	}
+	return r.Commit(nil)
+}
+
+func lstat(t *testing.T, path string) os.FileInfo {
+	t.Helper()
+
+	info, err := os.Lstat(path)
+	require.NoError(t, err)
+	return info
+}
+
+// requireClean checks that the worktree, the index and HEAD of the clone
+// agree.
+func requireClean(t *testing.T, path string) {
+	t.Helper()
+
+	repo, err := git.PlainOpen(path)
+	require.NoError(t, err)
+	w, err := repo.Worktree()
+	require.NoError(t, err)
+	status, err := w.Status()
+	require.NoError(t, err)
+	require.True(t, status.IsClean(), status.String())
+}
+
+func TestIncrementalCheckout(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.Commit(map[string]string{
+		"unchanged.txt":   "unchanged",
+		"changed.txt":     "v1",
+		"run.sh":          "echo run",
+		"dir/removed.txt": "removed",
+	})
+
+	path := filepath.Join(t.TempDir(), "repo")
+	s := NewSyncer(remote.Options(path))
+	require.NoError(t, s.ForceSync())
+	unchanged := lstat(t, filepath.Join(path, "unchanged.txt"))
+
+	// Only the files changed by the new commits are touched.
+	remote.Commit(map[string]string{"changed.txt": "v2", "dir/file": "file"})
+	remote.Chmod(0o755, "run.sh")
+	remote.Remove("dir/removed.txt", "dir/file")
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "changed.txt"), "v2")
+	require.Equal(t, os.FileMode(0o100), lstat(t, filepath.Join(path, "run.sh")).Mode()&0o100)
+	require.NoDirExists(t, filepath.Join(path, "dir"))
+	require.True(t, os.SameFile(unchanged, lstat(t, filepath.Join(path, "unchanged.txt"))))
+	requireClean(t, path)
+
+	// Without a new commit, files changed in the worktree are restored.
+	require.NoError(t, os.WriteFile(filepath.Join(path, "changed.txt"), []byte("drift"), 0o600))
+	require.NoError(t, os.Remove(filepath.Join(path, "run.sh")))
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "changed.txt"), "v2")
+	requireContent(t, filepath.Join(path, "run.sh"), "echo run")
+	require.True(t, os.SameFile(unchanged, lstat(t, filepath.Join(path, "unchanged.txt"))))
+	requireClean(t, path)
+
+	// A change that keeps the size and the modification time is only found
+	// by a new Syncer, which compares the content of every file.
+	info := lstat(t, filepath.Join(path, "changed.txt"))
+	require.NoError(t, os.WriteFile(filepath.Join(path, "changed.txt"), []byte("v3"), 0o600))
+	require.NoError(t, os.Chtimes(filepath.Join(path, "changed.txt"), info.ModTime(), info.ModTime()))
+	require.NoError(t, NewSyncer(remote.Options(path)).ForceSync())
+	requireContent(t, filepath.Join(path, "changed.txt"), "v2")
+	requireClean(t, path)
+}
+
+// cancelOnCheck is a context that is canceled once it was checked, like by a
+// Cancel right after the checkout started.
+type cancelOnCheck struct {
+	context.Context
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnCheck) Err() error {
+	err := c.Context.Err()
+	c.cancel()
+	return err
+}
+
+func TestCheckoutCanceled(t *testing.T) {
+	remote := newTestRemote(t)
+	v1 := map[string]string{}
+	v2 := map[string]string{}
+	for i := range 10 {
+		v1[fmt.Sprintf("file%d.txt", i)] = "v1"
+		v2[fmt.Sprintf("file%d.txt", i)] = "v2"
+	}
+	old := plumbing.NewHash(remote.Commit(v1))
+	remote.Commit(v2)
+
+	path := filepath.Join(t.TempDir(), "repo")
+	s := NewSyncer(remote.Options(path))
+	require.NoError(t, s.ForceSync())
+	repo, err := git.PlainOpen(path)
+	require.NoError(t, err)
+
+	// A context done before the checkout leaves the worktree alone.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, s.checkoutWorktree(ctx, repo, old), context.Canceled)
+	requireContent(t, filepath.Join(path, "file0.txt"), "v2")
+	requireClean(t, path)
+
+	// One done after it started lets it complete.
+	ctx, cancel = context.WithCancel(context.Background())
+	require.NoError(t, s.checkoutWorktree(&cancelOnCheck{Context: ctx, cancel: cancel}, repo, old))
+	for name := range v1 {
+		requireContent(t, filepath.Join(path, name), "v1")
+	}
+	requireClean(t, path)
+}
+
+func TestCheckoutUnsafePath(t *testing.T) {
+	for _, name := range []string{".git/hooks/post-checkout", "dir/.GIT/config", "../escape"} {
+		t.Run(name, func(t *testing.T) {
+			remote := newTestRemote(t)
+			path := filepath.Join(t.TempDir(), "repo")
+			s := NewSyncer(remote.Options(path))
+			require.NoError(t, s.ForceSync())
+
+			remote.CommitTree(map[string]string{"README.md": "pwned", name: "pwned"})
+			require.ErrorIs(t, s.ForceSync(), ErrUnsafePath)
+			// A new Syncer checks out every file of the tree.
+			require.ErrorIs(t, NewSyncer(remote.Options(path)).ForceSync(), ErrUnsafePath)
+
+			requireReadme(t, path, "initial")
+			require.NoFileExists(t, filepath.Join(path, ".git", "hooks", "post-checkout"))
+			require.NoDirExists(t, filepath.Join(path, "dir"))
+			require.NoFileExists(t, filepath.Join(filepath.Dir(path), "escape"))
+			requireClean(t, path)
+		})
+	}
+}
+
+func TestCheckoutUnsafeIndex(t *testing.T) {
+	remote := newTestRemote(t)
+	path := filepath.Join(t.TempDir(), "repo")
+	require.NoError(t, NewSyncer(remote.Options(path)).ForceSync())
+
+	// The file of an index entry that is not in the tree is removed, unless
+	// its path is unsafe.
+	repo, err := git.PlainOpen(path)
+	require.NoError(t, err)
+	idx, err := repo.Storer.Index()
+	require.NoError(t, err)
+	idx.Add(".git/config")
+	require.NoError(t, repo.Storer.SetIndex(idx))
+
+	require.ErrorIs(t, NewSyncer(remote.Options(path)).ForceSync(), ErrUnsafePath)
+	require.FileExists(t, filepath.Join(path, ".git", "config"))
+}
+
+// newBenchmarkSyncer syncs a remote with files files, of which the last
+// commit changed changed, and returns the Syncer, its clone and the two
+// commits.
+func newBenchmarkSyncer(b *testing.B, files int, changed int) (*Syncer, *git.Repository, [2]plumbing.Hash) {
+	b.Helper()
+
+	// Syncs log every checkout.
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	remote := newTestRemote(b)
+	for i := range files {
+		name := filepath.Join(remote.Path, benchmarkFile(i))
+		require.NoError(b, os.MkdirAll(filepath.Dir(name), 0o755))
+		require.NoError(b, os.WriteFile(name, []byte(fmt.Sprintf("%0512d", i)), 0o600))
+	}
+	w, err := remote.repo.Worktree()
+	require.NoError(b, err)
+	require.NoError(b, w.AddWithOptions(&git.AddOptions{All: true}))
+
+	var commits [2]plumbing.Hash
+	commits[0] = plumbing.NewHash(remote.Commit(nil))
+	update := map[string]string{}
+	for i := range changed {
+		update[benchmarkFile(i)] = "changed"
+	}
+	commits[1] = plumbing.NewHash(remote.Commit(update))
+
+	s := NewSyncer(remote.Options(filepath.Join(b.TempDir(), "repo")))
+	require.NoError(b, s.ForceSync())
+	repo, err := git.PlainOpen(s.Options.Path)
+	require.NoError(b, err)
+	return s, repo, commits
+}
+
+func benchmarkFile(i int) string {
+	return fmt.Sprintf("dir%02d/file%04d.txt", i%50, i)
+}
+
+// The benchmarks compare the checkout of the Syncer with the hard reset
+// go-git does for a pull, and that syncs without a new commit used to do.
+func BenchmarkCheckoutUnchanged(b *testing.B) {
+	b.Run("hard-reset", func(b *testing.B) {
+		_, repo, commits := newBenchmarkSyncer(b, 2000, 10)
+		w, err := repo.Worktree()
+		require.NoError(b, err)
+		for b.Loop() {
+			require.NoError(b, w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: commits[1]}))
+		}
+	})
+	b.Run("drift-check", func(b *testing.B) {
+		s, repo, commits := newBenchmarkSyncer(b, 2000, 10)
+		for b.Loop() {
+			require.NoError(b, s.checkoutWorktree(context.Background(), repo, commits[1]))
+		}
+	})
+}
+
+func BenchmarkCheckoutChanged(b *testing.B) {
+	b.Run("hard-reset", func(b *testing.B) {
+		_, repo, commits := newBenchmarkSyncer(b, 2000, 10)
+		w, err := repo.Worktree()
+		require.NoError(b, err)
+		i := 0
+		for b.Loop() {
+			require.NoError(b, w.Reset(&git.ResetOptions{Mode: git.HardReset, Commit: commits[i%2]}))
+			i++
+		}
+	})
+	b.Run("incremental", func(b *testing.B) {
+		s, repo, commits := newBenchmarkSyncer(b, 2000, 10)
+		i := 0
+		for b.Loop() {
+			require.NoError(b, s.checkoutWorktree(context.Background(), repo, commits[i%2]))
+			i++
+		}
+	})
+}
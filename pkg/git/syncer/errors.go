@@ -0,0 +1,106 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// The classes of sync errors. Errors returned by a sync wrap the class they
+// belong to, so callers can tell them apart with errors.Is.
+var (
+	ErrAuthentication     = errors.New("authentication failed")
+	ErrHostKeyMismatch    = errors.New("host key mismatch")
+	ErrNetworkUnreachable = errors.New("network unreachable")
+	ErrRefNotFound        = errors.New("reference not found")
+	ErrWorktreeCorrupt    = errors.New("worktree corrupt")
+	ErrDiskFull           = errors.New("local disk full")
+)
+
+// SyncError is an error of a known class. It reads like the error it wraps.
+type SyncError struct {
+	// Class is one of the error classes above.
+	Class error
+	Err   error
+}
+
+func (e *SyncError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *SyncError) Unwrap() []error {
+	return []error{e.Class, e.Err}
+}
+
+// classified wraps err into class, unless err is nil.
+func classified(class error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SyncError{Class: class, Err: err}
+}
+
+// classify wraps a sync error into the class it belongs to. Errors that
+// already have a class, or whose class is not known, are returned unchanged.
+func classify(err error) error {
+	if err == nil || hasClass(err) {
+		return err
+	}
+	if class := errorKind(err); class != nil {
+		return classified(class, err)
+	}
+	return err
+}
+
+func hasClass(err error) bool {
+	for _, class := range []error{
+		ErrAuthentication, ErrHostKeyMismatch, ErrNetworkUnreachable, ErrRefNotFound, ErrWorktreeCorrupt, ErrDiskFull,
+		ErrCommitNotFound, ErrHookFailed, ErrSubmoduleNotAllowed, ErrSyncCanceled, context.Canceled, context.DeadlineExceeded,
+	} {
+		if errors.Is(err, class) {
+			return true
+		}
+	}
+	return false
+}
+
+// errorKind recognizes the class of errors from go-git, the ssh and network
+// stacks and the file system.
+func errorKind(err error) error {
+	var keyErr *knownhosts.KeyError
+	var revokedErr *knownhosts.RevokedError
+	var refSpecErr git.NoMatchingRefSpecError
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, syscall.EDQUOT):
+		return ErrDiskFull
+	case errors.As(err, &keyErr), errors.As(err, &revokedErr):
+		return ErrHostKeyMismatch
+	case errors.Is(err, transport.ErrAuthenticationRequired), errors.Is(err, transport.ErrAuthorizationFailed),
+		strings.Contains(err.Error(), "ssh: unable to authenticate"):
+		return ErrAuthentication
+	case errors.Is(err, plumbing.ErrReferenceNotFound), errors.Is(err, ErrNoMatchingTag), errors.As(err, &refSpecErr):
+		return ErrRefNotFound
+	// A missing target commit wraps ErrCommitNotFound where it is looked up,
+	// any other missing object means the object store is damaged.
+	case errors.Is(err, plumbing.ErrObjectNotFound), errors.Is(err, index.ErrMalformedSignature),
+		errors.Is(err, index.ErrInvalidChecksum), errors.Is(err, index.ErrUnsupportedVersion),
+		// A clone finding leftovers of a repository that cannot be opened.
+		errors.Is(err, git.ErrRepositoryAlreadyExists), errors.Is(err, git.ErrRemoteExists):
+		return ErrWorktreeCorrupt
+	case errors.As(err, &netErr), errors.Is(err, syscall.ECONNREFUSED), errors.Is(err, syscall.ENETUNREACH),
+		errors.Is(err, syscall.EHOSTUNREACH):
+		return ErrNetworkUnreachable
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,65 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/format/index"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestClassify(t *testing.T) {
+	for _, tc := range []struct {
+		err   error
+		class error
+	}{
+		{transport.ErrAuthenticationRequired, ErrAuthentication},
+		{errors.New("ssh: handshake failed: ssh: unable to authenticate, attempted methods [none publickey]"), ErrAuthentication},
+		{fmt.Errorf("ssh: handshake failed: %w", &knownhosts.KeyError{}), ErrHostKeyMismatch},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, ErrNetworkUnreachable},
+		{plumbing.ErrReferenceNotFound, ErrRefNotFound},
+		{ErrNoMatchingTag, ErrRefNotFound},
+		{plumbing.ErrObjectNotFound, ErrWorktreeCorrupt},
+		{fmt.Errorf("%w: %w", ErrCommitNotFound, plumbing.ErrObjectNotFound), ErrCommitNotFound},
+		{index.ErrInvalidChecksum, ErrWorktreeCorrupt},
+		{&os.PathError{Op: "write", Path: "/data/repo/file", Err: syscall.ENOSPC}, ErrDiskFull},
+	} {
+		err := classify(fmt.Errorf("fetch failed: %w", tc.err))
+		require.ErrorIs(t, err, tc.class, "%v", tc.err)
+		require.ErrorIs(t, err, tc.err)
+		require.Equal(t, "fetch failed: "+tc.err.Error(), err.Error(), "the message is unchanged")
+	}
+
+	err := errors.New("something else")
+	require.Equal(t, err, classify(err))
+	require.Equal(t, context.Canceled, classify(context.Canceled))
+	require.NoError(t, classify(nil))
+}
+
+func TestSyncErrors(t *testing.T) {
+	remote := newTestRemote(t)
+	opts := remote.Options(filepath.Join(t.TempDir(), "repo"))
+	opts.RefName = plumbing.NewBranchReferenceName("missing")
+	s := NewSyncer(opts)
+
+	err := s.ForceSync()
+	require.ErrorIs(t, err, ErrRefNotFound)
+	require.Equal(t, "reference_not_found", errorClass(err))
+
+	s.Options.RefName = plumbing.NewBranchReferenceName("main")
+	require.NoError(t, s.ForceSync())
+
+	// A repository without a HEAD cannot be opened, so it is cloned again
+	// over the leftovers.
+	require.NoError(t, os.Remove(filepath.Join(opts.Path, ".git", "HEAD")))
+	require.ErrorIs(t, s.ForceSync(), ErrWorktreeCorrupt)
+}
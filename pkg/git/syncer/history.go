@@ -0,0 +1,91 @@
+package syncer
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+// DefaultHistoryLimit is the number of sync attempts kept by default.
+const DefaultHistoryLimit = 100
+
+// The results of a sync recorded in HistoryEntry.Result.
+const (
+	ResultSucceeded = "succeeded"
+	ResultFailed    = "failed"
+	ResultCanceled  = "canceled"
+)
+
+// HistoryOptions configure the sync history.
+type HistoryOptions struct {
+	// Limit is the number of sync attempts kept. Zero means
+	// DefaultHistoryLimit, a negative value disables the history.
+	Limit int
+	// Persist saves the history to the state file, so it survives restarts.
+	Persist bool
+}
+
+func (o HistoryOptions) limit() int {
+	if o.Limit == 0 {
+		return DefaultHistoryLimit
+	}
+	return max(o.Limit, 0)
+}
+
+// HistoryEntry records a sync attempt. OldHash and NewHash are the commits
+// before and after the sync, and are equal when the commit did not change.
+type HistoryEntry struct {
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	OldHash      string    `json:"old_commit,omitempty"`
+	NewHash      string    `json:"new_commit,omitempty"`
+	Result       string    `json:"result"`
+	Error        string    `json:"error,omitempty"`
+	ChangedFiles int       `json:"changed_files"`
+}
+
+// History returns the recorded sync attempts, oldest first.
+func (s *Syncer) History() []HistoryEntry {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+	return slices.Clone(s.history)
+}
+
+// recordHistory adds the sync that started at start and changed the commit
+// from oldHash, or applied change, to the history. It must be called with
+// syncLock held.
+func (s *Syncer) recordHistory(start time.Time, oldHash string, change *hookEvent, err error) {
+	entry := HistoryEntry{
+		Started:  start,
+		Finished: time.Now(),
+		OldHash:  oldHash,
+		NewHash:  s.status.LatestHash,
+		Result:   ResultSucceeded,
+	}
+	if change != nil {
+		if !change.OldHash.IsZero() {
+			entry.OldHash = change.OldHash.String()
+		}
+		entry.ChangedFiles = len(change.ChangedFiles)
+	}
+	if err != nil {
+		entry.Result = ResultFailed
+		if errors.Is(err, ErrSyncCanceled) {
+			entry.Result = ResultCanceled
+		}
+		entry.Error = err.Error()
+	}
+
+	s.statusLock.Lock()
+	s.history = appendHistory(s.history, s.Options.History.limit(), entry)
+	s.statusLock.Unlock()
+}
+
+// appendHistory appends the entries and drops the oldest ones beyond limit.
+func appendHistory(history []HistoryEntry, limit int, entries ...HistoryEntry) []HistoryEntry {
+	history = append(history, entries...)
+	if len(history) > limit {
+		history = history[len(history)-limit:]
+	}
+	return history
+}
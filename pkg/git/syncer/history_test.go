@@ -0,0 +1,53 @@
+package syncer
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHistory(t *testing.T) {
+	remote := newTestRemote(t)
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.History = HistoryOptions{Limit: 3, Persist: true}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	first := s.Status().LatestHash
+	second := remote.Commit(map[string]string{"a.txt": "a", "b.txt": "b"})
+	require.NoError(t, s.ForceSync())
+
+	history := s.History()
+	require.Len(t, history, 2)
+	require.Empty(t, history[0].OldHash)
+	require.Equal(t, first, history[0].NewHash)
+	require.Equal(t, 1, history[0].ChangedFiles)
+	require.Equal(t, first, history[1].OldHash)
+	require.Equal(t, second, history[1].NewHash)
+	require.Equal(t, 2, history[1].ChangedFiles)
+	require.Equal(t, ResultSucceeded, history[1].Result)
+	require.False(t, history[1].Finished.Before(history[1].Started))
+
+	s.Options.RefName = plumbing.NewBranchReferenceName("missing")
+	require.Error(t, s.ForceSync())
+	require.Error(t, s.ForceSync())
+
+	history = s.History()
+	require.Len(t, history, 3, "the oldest entries are dropped")
+	require.Equal(t, second, history[0].NewHash)
+	require.Equal(t, ResultFailed, history[2].Result)
+	require.Contains(t, history[2].Error, "reference not found")
+	require.Equal(t, second, history[2].OldHash)
+	require.Equal(t, second, history[2].NewHash)
+
+	restored := NewSyncer(opts).History()
+	require.Len(t, restored, 3)
+	require.Equal(t, history[2].Error, restored[2].Error)
+	require.True(t, history[2].Started.Equal(restored[2].Started))
+
+	opts.History.Persist = false
+	require.Empty(t, NewSyncer(opts).History())
+}
@@ -0,0 +1,238 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	DefaultHookTimeout = time.Minute
+
+	HookPhasePreSync  = "pre-sync"
+	HookPhasePostSync = "post-sync"
+
+	// maxHookOutput is the number of trailing output bytes kept per hook.
+	maxHookOutput = 4096
+	// hookWaitDelay is how long a hook that exited, or was killed, may leave
+	// other processes holding its output open.
+	hookWaitDelay = time.Second
+	// maxChangedFilesEnv caps GIT_SYNC_CHANGED_FILES so the environment stays
+	// below the size limits of exec.
+	maxChangedFilesEnv = 64 * 1024
+)
+
+var ErrHookFailed = errors.New("hook failed")
+
+// Hook is a command run when the synced commit changes.
+type Hook struct {
+	// Name identifies the hook in the status. Defaults to the command.
+	Name    string
+	Command []string
+	// Timeout defaults to DefaultHookTimeout.
+	Timeout time.Duration
+}
+
+// HookOptions configures the commands run around a change of the synced
+// commit. Pre-sync hooks run before the worktree is updated and a failing
+// pre-sync hook aborts the update. Post-sync hooks run after the update.
+//
+// Hooks run in Path with the process environment plus:
+//
+//	GIT_SYNC_OLD_HASH            the commit before the update, empty for a new clone
+//	GIT_SYNC_NEW_HASH            the commit after the update
+//	GIT_SYNC_REF                 the synced reference
+//	GIT_SYNC_PATH                the synced path
+//	GIT_SYNC_CHANGED_FILES       the changed files, one per line
+//	GIT_SYNC_CHANGED_FILES_COUNT the number of changed files
+//
+// GIT_SYNC_CHANGED_FILES is left empty when the list is too long for the
+// environment, in which case GIT_SYNC_CHANGED_FILES_TRUNCATED is "true".
+type HookOptions struct {
+	PreSync  []Hook
+	PostSync []Hook
+}
+
+type HookResult struct {
+	Name      string        `json:"name"`
+	Phase     string        `json:"phase"`
+	StartedAt time.Time     `json:"started_at"`
+	Duration  time.Duration `json:"duration"`
+	ExitCode  int           `json:"exit_code"`
+	Output    string        `json:"output,omitempty"`
+	Error     string        `json:"error,omitempty"`
+}
+
+// hookEvent describes the commit change the hooks run for.
+type hookEvent struct {
+	RefName      plumbing.ReferenceName
+	OldHash      plumbing.Hash
+	NewHash      plumbing.Hash
+	ChangedFiles []string
+}
+
+func (e hookEvent) env(path string) []string {
+	oldHash := ""
+	if !e.OldHash.IsZero() {
+		oldHash = e.OldHash.String()
+	}
+
+	changed := strings.Join(e.ChangedFiles, "\n")
+	truncated := len(changed) > maxChangedFilesEnv
+	if truncated {
+		changed = ""
+	}
+
+	return append(os.Environ(),
+		"GIT_SYNC_OLD_HASH="+oldHash,
+		"GIT_SYNC_NEW_HASH="+e.NewHash.String(),
+		"GIT_SYNC_REF="+e.RefName.String(),
+		"GIT_SYNC_PATH="+path,
+		"GIT_SYNC_CHANGED_FILES="+changed,
+		"GIT_SYNC_CHANGED_FILES_COUNT="+strconv.Itoa(len(e.ChangedFiles)),
+		"GIT_SYNC_CHANGED_FILES_TRUNCATED="+strconv.FormatBool(truncated),
+	)
+}
+
+// runHooks runs the hooks one after another, records their results in the
+// status and stops at the first failure.
+func (s *Syncer) runHooks(ctx context.Context, phase string, hooks []Hook, event hookEvent) error {
+	// Path does not exist yet before the first publish.
+	dir := s.Options.Path
+	if _, err := os.Stat(dir); err != nil {
+		dir = ""
+	}
+
+	for _, hook := range hooks {
+		result := runHook(ctx, hook, phase, dir, event.env(s.Options.Path))
+		s.status.Hooks = append(s.status.Hooks, result)
+
+		if result.Error != "" {
+			log.Printf("%s hook %s failed: %s\n%s", phase, result.Name, result.Error, result.Output)
+			return fmt.Errorf("%w: %s hook %s: %s", ErrHookFailed, phase, result.Name, result.Error)
+		}
+		log.Printf("%s hook %s completed in %s", phase, result.Name, result.Duration)
+	}
+	return nil
+}
+
+func runHook(ctx context.Context, hook Hook, phase string, dir string, env []string) HookResult {
+	result := HookResult{
+		Name:      hook.Name,
+		Phase:     phase,
+		StartedAt: time.Now(),
+	}
+	if result.Name == "" {
+		result.Name = strings.Join(hook.Command, " ")
+	}
+	if len(hook.Command) == 0 {
+		result.ExitCode = -1
+		result.Error = "no command"
+		return result
+	}
+
+	timeout := hook.Timeout
+	if timeout <= 0 {
+		timeout = DefaultHookTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	output := &tailBuffer{limit: maxHookOutput}
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...) //nolint:gosec // hooks are configured by the operator
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.Stdout = output
+	cmd.Stderr = output
+	cmd.WaitDelay = hookWaitDelay
+	killProcessGroup(cmd)
+
+	err := cmd.Run()
+	result.Duration = time.Since(result.StartedAt)
+	result.Output = string(output.buf)
+	result.ExitCode = cmd.ProcessState.ExitCode()
+
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		result.Error = fmt.Sprintf("timed out after %s", timeout)
+	case errors.Is(err, exec.ErrWaitDelay):
+		// The hook succeeded, but a process it left in the background still
+		// holds its output.
+		log.Printf("%s hook %s left processes running in the background", phase, result.Name)
+	case err != nil:
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// changedFiles returns the paths that differ between the trees of the two
+// commits. All files of the new commit are returned when there is no old
+// commit.
+func changedFiles(repo *git.Repository, oldHash plumbing.Hash, newHash plumbing.Hash) ([]string, error) {
+	newCommit, err := repo.CommitObject(newHash)
+	if err != nil {
+		return nil, err
+	}
+	newTree, err := newCommit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	var oldTree *object.Tree
+	if !oldHash.IsZero() {
+		if oldCommit, err := repo.CommitObject(oldHash); err == nil {
+			oldTree, err = oldCommit.Tree()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if oldTree == nil {
+		var files []string
+		err = walkFiles(newTree, func(name string, _ object.TreeEntry) error {
+			files = append(files, name)
+			return nil
+		})
+		return files, err
+	}
+
+	changes, err := object.DiffTree(oldTree, newTree)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(changes))
+	for _, change := range changes {
+		name := change.To.Name
+		if name == "" {
+			name = change.From.Name
+		}
+		files = append(files, name)
+	}
+	return files, nil
+}
+
+// tailBuffer is an io.Writer that keeps the last limit bytes written to it.
+type tailBuffer struct {
+	limit int
+	buf   []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.limit {
+		b.buf = b.buf[len(b.buf)-b.limit:]
+	}
+	return len(p), nil
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package syncer
+
+import "os/exec"
+
+// killProcessGroup leaves the command as it is, only the command itself is
+// killed when it is canceled.
+func killProcessGroup(*exec.Cmd) {}
@@ -0,0 +1,82 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHooks(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+	envFile := filepath.Join(root, "env")
+
+	opts := remote.Options(filepath.Join(root, "repo"))
+	opts.Hooks = HookOptions{
+		PreSync: []Hook{{Name: "check", Command: []string{"sh", "-c", "echo checking; test ! -f $GIT_SYNC_PATH/block"}}},
+		PostSync: []Hook{{Command: []string{
+			"sh", "-c", `printf '%s|%s|%s|%s' "$GIT_SYNC_OLD_HASH" "$GIT_SYNC_NEW_HASH" "$GIT_SYNC_REF" "$GIT_SYNC_CHANGED_FILES" > ` + envFile,
+		}}},
+	}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	first := s.Status().LatestHash
+	require.Len(t, s.Status().Hooks, 1, "pre-sync hooks do not run for a new clone")
+	requireFile(t, envFile, "|"+first+"|refs/heads/main|README.md")
+
+	second := remote.Commit(map[string]string{"app.conf": "x"})
+	require.NoError(t, s.ForceSync())
+	requireFile(t, envFile, first+"|"+second+"|refs/heads/main|app.conf")
+
+	hooks := s.Status().Hooks
+	require.Len(t, hooks, 2)
+	require.Equal(t, "check", hooks[0].Name)
+	require.Equal(t, HookPhasePreSync, hooks[0].Phase)
+	require.Equal(t, "checking\n", hooks[0].Output)
+	require.Equal(t, HookPhasePostSync, hooks[1].Phase)
+
+	// No change, no hooks.
+	require.NoError(t, os.Remove(envFile))
+	require.NoError(t, s.ForceSync())
+	require.NoFileExists(t, envFile)
+
+	// A failing pre-sync hook aborts the update.
+	require.NoError(t, os.WriteFile(filepath.Join(opts.Path, "block"), nil, 0o600))
+	remote.Commit(map[string]string{"README.md": "blocked"})
+	require.ErrorIs(t, s.ForceSync(), ErrHookFailed)
+	requireReadme(t, opts.Path, "initial")
+	require.Equal(t, second, s.Status().LatestHash)
+	require.Equal(t, 1, s.Status().Hooks[0].ExitCode)
+	require.NoFileExists(t, envFile)
+}
+
+func TestHookTimeout(t *testing.T) {
+	result := runHook(t.Context(), Hook{Command: []string{"sleep", "5"}, Timeout: 10 * time.Millisecond}, HookPhasePostSync, "", nil)
+	require.Contains(t, result.Error, "timed out")
+}
+
+func TestHookBackgroundProcess(t *testing.T) {
+	// A process left in the background does not keep the hook running.
+	start := time.Now()
+	result := runHook(t.Context(), Hook{Command: []string{"sh", "-c", "sleep 100 &"}, Timeout: time.Minute}, HookPhasePostSync, "", nil)
+	require.Empty(t, result.Error)
+	require.Less(t, time.Since(start), 10*time.Second)
+
+	// Nor does it keep a hook that timed out.
+	start = time.Now()
+	result = runHook(t.Context(), Hook{Command: []string{"sh", "-c", "sleep 100 & sleep 100"}, Timeout: 10 * time.Millisecond}, HookPhasePostSync, "", nil)
+	require.Contains(t, result.Error, "timed out")
+	require.Less(t, time.Since(start), 10*time.Second)
+}
+
+func requireFile(t *testing.T, path string, expected string) {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, expected, string(content))
+}
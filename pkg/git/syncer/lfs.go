@@ -0,0 +1,586 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	giturls "github.com/clbiggs/git-sync/pkg/git/git-urls"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	httpgit "github.com/go-git/go-git/v5/plumbing/transport/http"
+)
+
+const (
+	lfsPointerVersion = "https://git-lfs.github.com/spec/v1"
+	// lfsMaxPointerSize is the size pointer files stay below.
+	lfsMaxPointerSize = 1024
+	// lfsBatchSize is the number of objects requested at once, like git lfs
+	// does.
+	lfsBatchSize = 100
+	lfsMediaType = "application/vnd.git-lfs+json"
+)
+
+// LFSOptions configures the download of Git LFS objects. Files marked with
+// filter=lfs in the .gitattributes of the commit are checked out with the
+// content of their object rather than the pointer file committed for them.
+type LFSOptions struct {
+	Enabled bool
+	// URL is the LFS server. Defaults to the info/lfs endpoint of the
+	// repository URL, e.g. https://github.com/org/app.git/info/lfs.
+	URL string
+	// Include are patterns of the files whose objects are downloaded, and
+	// Exclude of the files left as pointers. A pattern without a / matches
+	// the file name, others the path or a directory above it.
+	Include []string
+	Exclude []string
+	// CacheDir keeps the downloaded objects. Defaults to the lfs/objects
+	// directory in .git, like git lfs uses.
+	CacheDir string
+}
+
+func (o LFSOptions) match(name string) bool {
+	matches := func(pattern string) bool {
+		return matchLFSPattern(pattern, name)
+	}
+	return (len(o.Include) == 0 || slices.ContainsFunc(o.Include, matches)) && !slices.ContainsFunc(o.Exclude, matches)
+}
+
+func matchLFSPattern(pattern string, name string) bool {
+	pattern = strings.Trim(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		if ok, _ := path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	for p := name; p != "."; p = path.Dir(p) {
+		if ok, _ := path.Match(pattern, p); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// lfsCacheDir returns the directory the LFS objects are kept in.
+func (o SyncOptions) lfsCacheDir() string {
+	if o.LFS.CacheDir != "" {
+		return o.LFS.CacheDir
+	}
+	return filepath.Join(o.repoPath(), ".git", "lfs", "objects")
+}
+
+// lfsURL returns the URL of the LFS server.
+func (o SyncOptions) lfsURL() (string, error) {
+	if o.LFS.URL != "" {
+		return strings.TrimSuffix(o.LFS.URL, "/"), nil
+	}
+
+	u, err := giturls.Parse(o.Auth.Repo)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "https":
+	case "ssh":
+		// The server is assumed to serve LFS over https, like git lfs does
+		// without ssh authentication.
+		u.Scheme = "https"
+		u.User = nil
+		u.Host = u.Hostname()
+	default:
+		return "", fmt.Errorf("no LFS server known for %s, set the LFS URL", o.Auth.Repo)
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	if !strings.HasSuffix(u.Path, ".git") {
+		u.Path += ".git"
+	}
+	u.Path += "/info/lfs"
+	return u.String(), nil
+}
+
+// lfsPointer is the content of a pointer file, which names an LFS object.
+type lfsPointer struct {
+	OID  string `json:"oid"`
+	Size int64  `json:"size"`
+}
+
+// parseLFSPointer parses the content of a pointer file.
+func parseLFSPointer(content []byte) (lfsPointer, bool) {
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) < 3 || lines[0] != "version "+lfsPointerVersion {
+		return lfsPointer{}, false
+	}
+
+	var p lfsPointer
+	for _, line := range lines[1:] {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "oid":
+			oid, ok := strings.CutPrefix(value, "sha256:")
+			if !ok || len(oid) != sha256.Size*2 || strings.ToLower(oid) != oid {
+				return lfsPointer{}, false
+			}
+			if _, err := hex.DecodeString(oid); err != nil {
+				return lfsPointer{}, false
+			}
+			p.OID = oid
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return lfsPointer{}, false
+			}
+			p.Size = size
+		}
+	}
+	return p, p.OID != ""
+}
+
+// lfsFiles are the pointer files of a commit that are checked out with the
+// content of their LFS object.
+type lfsFiles struct {
+	cacheDir string
+	pointers map[string]lfsPointer
+	// attributes are the .gitattributes files of the commit.
+	attributes gitattributes.Matcher
+}
+
+func (f *lfsFiles) pointer(name string) (lfsPointer, bool) {
+	if f == nil {
+		return lfsPointer{}, false
+	}
+	p, ok := f.pointers[name]
+	return p, ok
+}
+
+func (f *lfsFiles) objectPath(oid string) string {
+	return filepath.Join(f.cacheDir, oid[0:2], oid[2:4], oid)
+}
+
+// open returns the content of the file to check out, which is the cached
+// object for a pointer file.
+func (f *lfsFiles) open(file *object.File) (io.ReadCloser, error) {
+	if p, ok := f.pointer(file.Name); ok {
+		return os.Open(f.objectPath(p.OID))
+	}
+	return file.Reader()
+}
+
+// matches reports whether the file at target has the content of the object.
+func (f *lfsFiles) matches(target string, p lfsPointer) bool {
+	//nolint:gosec // the target is below the worktree
+	file, err := os.Open(target)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(hash, file)
+	return err == nil && n == p.Size && hex.EncodeToString(hash.Sum(nil)) == p.OID
+}
+
+// prepareLFS finds the pointer files of the tree selected by the sparse and
+// LFS options, and downloads the objects missing from the cache. It returns
+// nil when LFS is disabled.
+//
+// With last, the pointer files of the tree from the worktree was checked out
+// at, only the files that changed since are read, and nothing at all for the
+// same tree. A changed .gitattributes file reads the whole tree again.
+func (s *Syncer) prepareLFS(ctx context.Context, tree *object.Tree, from *object.Tree, last *lfsFiles) (*lfsFiles, error) {
+	if !s.Options.LFS.Enabled {
+		return nil, nil
+	}
+	if from == nil || last == nil {
+		return s.readLFS(ctx, tree)
+	}
+	if from.Hash == tree.Hash {
+		return last, nil
+	}
+
+	changes, err := object.DiffTreeWithOptions(ctx, from, tree, nil)
+	if err != nil {
+		return nil, err
+	}
+	if slices.ContainsFunc(changes, changesAttributes) {
+		return s.readLFS(ctx, tree)
+	}
+
+	files := &lfsFiles{cacheDir: last.cacheDir, pointers: maps.Clone(last.pointers), attributes: last.attributes}
+	for _, change := range changes {
+		delete(files.pointers, change.From.Name)
+	}
+	added := map[string]lfsPointer{}
+	for _, change := range changes {
+		if change.To.Name == "" {
+			continue
+		}
+		p, ok, err := s.readLFSPointer(tree, files.attributes, change.To.Name, change.To.TreeEntry)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			files.pointers[change.To.Name] = p
+			added[change.To.Name] = p
+		}
+	}
+
+	if err = s.downloadLFS(ctx, files, added); err != nil {
+		return nil, fmt.Errorf("LFS download failed: %w", err)
+	}
+	return files, nil
+}
+
+// readLFS finds the pointer files of the whole tree and downloads their
+// objects missing from the cache.
+func (s *Syncer) readLFS(ctx context.Context, tree *object.Tree) (*lfsFiles, error) {
+	attributes, err := readAttributes(tree)
+	if err != nil {
+		return nil, err
+	}
+
+	files := &lfsFiles{cacheDir: s.Options.lfsCacheDir(), pointers: map[string]lfsPointer{}, attributes: attributes}
+	err = walkFiles(tree, func(name string, entry object.TreeEntry) error {
+		p, ok, err := s.readLFSPointer(tree, attributes, name, entry)
+		if ok {
+			files.pointers[name] = p
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.downloadLFS(ctx, files, files.pointers); err != nil {
+		return nil, fmt.Errorf("LFS download failed: %w", err)
+	}
+	return files, nil
+}
+
+// readLFSPointer returns the pointer of the file of the tree if it is
+// selected by the sparse and LFS options and marked with filter=lfs. Only the
+// blobs of pointer files are read, the sizes of the others are not known
+// without them.
+func (s *Syncer) readLFSPointer(tree *object.Tree, attributes gitattributes.Matcher, name string, entry object.TreeEntry) (lfsPointer, bool, error) {
+	if !entry.Mode.IsRegular() || !s.Options.Sparse.match(name) || !s.Options.LFS.match(name) {
+		return lfsPointer{}, false, nil
+	}
+	attrs, _ := attributes.Match(strings.Split(name, "/"), []string{"filter"})
+	if filter, ok := attrs["filter"]; !ok || filter.Value() != "lfs" {
+		return lfsPointer{}, false, nil
+	}
+
+	f, err := treeFile(tree, name, entry)
+	if err != nil || f.Size >= lfsMaxPointerSize {
+		return lfsPointer{}, false, err
+	}
+	content, err := f.Contents()
+	if err != nil {
+		return lfsPointer{}, false, err
+	}
+	p, ok := parseLFSPointer([]byte(content))
+	return p, ok, nil
+}
+
+// changesAttributes reports whether the change adds, removes or modifies a
+// .gitattributes file.
+func changesAttributes(change *object.Change) bool {
+	return path.Base(change.From.Name) == ".gitattributes" || path.Base(change.To.Name) == ".gitattributes"
+}
+
+// readAttributes reads the .gitattributes files of the tree.
+func readAttributes(tree *object.Tree) (gitattributes.Matcher, error) {
+	var files []*object.File
+	err := walkFiles(tree, func(name string, entry object.TreeEntry) error {
+		if path.Base(name) != ".gitattributes" {
+			return nil
+		}
+		f, err := treeFile(tree, name, entry)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The files further down the tree take precedence.
+	slices.SortStableFunc(files, func(a, b *object.File) int {
+		return strings.Count(a.Name, "/") - strings.Count(b.Name, "/")
+	})
+
+	var stack []gitattributes.MatchAttribute
+	for _, f := range files {
+		var domain []string
+		if dir := path.Dir(f.Name); dir != "." {
+			domain = strings.Split(dir, "/")
+		}
+
+		content, err := f.Contents()
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := gitattributes.ReadAttributes(strings.NewReader(content), domain, domain == nil)
+		if err != nil {
+			// git ignores the file as well.
+			log.Printf("Ignoring %s: %v", f.Name, err)
+			continue
+		}
+		stack = append(stack, attrs...)
+	}
+	return gitattributes.NewMatcher(stack), nil
+}
+
+type lfsBatchRequest struct {
+	Operation string       `json:"operation"`
+	Transfers []string     `json:"transfers"`
+	Objects   []lfsPointer `json:"objects"`
+	HashAlgo  string       `json:"hash_algo"`
+}
+
+type lfsBatchResponse struct {
+	Objects []lfsBatchObject `json:"objects"`
+}
+
+type lfsBatchObject struct {
+	lfsPointer
+
+	Actions struct {
+		Download *lfsAction `json:"download"`
+	} `json:"actions"`
+	Error *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header"`
+}
+
+// lfsClient talks to the LFS server with the credentials and TLS settings of
+// the repository.
+type lfsClient struct {
+	url      string
+	client   *http.Client
+	username string
+	password string
+}
+
+func (s *Syncer) newLFSClient() (*lfsClient, error) {
+	endpoint, err := s.Options.lfsURL()
+	if err != nil {
+		return nil, err
+	}
+
+	caBundle, err := getCABundleFromFile(s.Options.CABuntleFile)
+	if err != nil {
+		return nil, err
+	}
+	//nolint:gosec // skipping the verification is opt-in, like for git
+	tlsConfig := &tls.Config{InsecureSkipVerify: s.Options.Auth.InsecureSkipTLS}
+	if caBundle != nil {
+		// Like go-git, trust the bundle in addition to the system roots.
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(caBundle) {
+			return nil, errors.New("no certificates found in the CA bundle")
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport, _ := http.DefaultTransport.(*http.Transport)
+	transport = transport.Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	c := &lfsClient{url: endpoint, client: &http.Client{Transport: transport}}
+	auth, err := createAuthFromOpts(s.Options.Auth)
+	if err != nil {
+		return nil, err
+	}
+	if basic, ok := auth.(*httpgit.BasicAuth); ok {
+		c.username, c.password = basic.Username, basic.Password
+	}
+	return c, nil
+}
+
+// downloadLFS downloads the objects of the pointers that are not in the
+// cache of the files, in a sync slot within the fetch timeout.
+func (s *Syncer) downloadLFS(ctx context.Context, files *lfsFiles, pointers map[string]lfsPointer) error {
+	var missing []lfsPointer
+	for _, p := range pointers {
+		if slices.Contains(missing, p) {
+			continue
+		}
+		if info, err := os.Stat(files.objectPath(p.OID)); err == nil && info.Size() == p.Size {
+			continue
+		}
+		missing = append(missing, p)
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	client, err := s.newLFSClient()
+	if err != nil {
+		return err
+	}
+	return s.download(ctx, OperationLFS, func(ctx context.Context) error {
+		return client.downloadAll(ctx, files, missing)
+	})
+}
+
+// downloadAll downloads the objects into the cache of the files.
+func (c *lfsClient) downloadAll(ctx context.Context, files *lfsFiles, missing []lfsPointer) error {
+	log.Printf("Downloading %d LFS objects from %s", len(missing), c.url)
+	var size int64
+	for chunk := range slices.Chunk(missing, lfsBatchSize) {
+		objects, err := c.batch(ctx, chunk)
+		if err != nil {
+			return err
+		}
+		for _, obj := range objects {
+			if obj.Error != nil {
+				return fmt.Errorf("object %s: %s (%d)", obj.OID, obj.Error.Message, obj.Error.Code)
+			}
+			if obj.Actions.Download == nil {
+				return fmt.Errorf("object %s: no download action", obj.OID)
+			}
+			if err = c.download(ctx, *obj.Actions.Download, obj.lfsPointer, files.objectPath(obj.OID)); err != nil {
+				return fmt.Errorf("object %s: %w", obj.OID, err)
+			}
+			size += obj.Size
+		}
+	}
+	log.Printf("Downloaded %d LFS objects, %d bytes", len(missing), size)
+	return nil
+}
+
+// batch asks the server where to download the objects from.
+func (c *lfsClient) batch(ctx context.Context, objects []lfsPointer) ([]lfsBatchObject, error) {
+	body, err := json.Marshal(lfsBatchRequest{
+		Operation: "download",
+		Transfers: []string{"basic"},
+		Objects:   objects,
+		HashAlgo:  "sha256",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", lfsMediaType)
+	req.Header.Set("Content-Type", lfsMediaType)
+	if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err = statusError("batch request", resp); err != nil {
+		return nil, err
+	}
+
+	var batch lfsBatchResponse
+	if err = json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("invalid batch response: %w", err)
+	}
+	return batch.Objects, nil
+}
+
+// download downloads the object into the cache, verifying its size and hash.
+func (c *lfsClient) download(ctx context.Context, action lfsAction, p lfsPointer, target string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, action.Href, http.NoBody)
+	if err != nil {
+		return err
+	}
+	for key, value := range action.Header {
+		req.Header.Set(key, value)
+	}
+	// Objects stored next to the server are downloaded with the same
+	// credentials, others are expected to bring their own in the header.
+	if req.Header.Get("Authorization") == "" && c.username != "" && sameHost(c.url, action.Href) {
+		req.SetBasicAuth(c.username, c.password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err = statusError("download", resp); err != nil {
+		return err
+	}
+
+	//nolint:gosec // the cache is read by the checkout
+	if err = os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, hash), io.LimitReader(resp.Body, p.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != p.Size || hex.EncodeToString(hash.Sum(nil)) != p.OID {
+		return errors.New("downloaded content does not match the pointer")
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// statusError returns an error for a response that did not succeed.
+func statusError(request string, resp *http.Response) error {
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return classified(ErrAuthentication, fmt.Errorf("%s failed: %s", request, resp.Status))
+	case resp.StatusCode != http.StatusOK:
+		return fmt.Errorf("%s failed: %s", request, resp.Status)
+	default:
+		return nil
+	}
+}
+
+func sameHost(a string, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+	ub, err := url.Parse(b)
+	return err == nil && ua.Host == ub.Host
+}
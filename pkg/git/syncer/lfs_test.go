@@ -0,0 +1,232 @@
+package syncer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// lfsServer serves LFS objects with the batch API.
+type lfsServer struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	objects   map[string]string
+	batches   int
+	downloads int
+	username  string
+}
+
+func newLFSServer(t *testing.T) *lfsServer {
+	t.Helper()
+
+	s := &lfsServer{objects: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /objects/batch", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.batches++
+		s.username, _, _ = r.BasicAuth()
+
+		var req lfsBatchRequest
+		if r.Header.Get("Accept") != lfsMediaType || json.NewDecoder(r.Body).Decode(&req) != nil {
+			http.Error(w, "bad request", http.StatusBadRequest)
+			return
+		}
+		var resp lfsBatchResponse
+		for _, p := range req.Objects {
+			obj := lfsBatchObject{lfsPointer: p}
+			obj.Actions.Download = &lfsAction{Href: s.URL + "/objects/" + p.OID}
+			resp.Objects = append(resp.Objects, obj)
+		}
+		w.Header().Set("Content-Type", lfsMediaType)
+		_ = json.NewEncoder(w).Encode(resp)
+	})
+	mux.HandleFunc("GET /objects/{oid}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.downloads++
+		_, _ = w.Write([]byte(s.objects[r.PathValue("oid")]))
+	})
+	s.Server = httptest.NewServer(mux)
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Pointer stores the content as an object and returns its pointer file.
+func (s *lfsServer) Pointer(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	oid := hex.EncodeToString(sum[:])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[oid] = content
+	return fmt.Sprintf("version %s\noid sha256:%s\nsize %d\n", lfsPointerVersion, oid, len(content))
+}
+
+func (s *lfsServer) Batches() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.batches
+}
+
+func (s *lfsServer) Downloads() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloads
+}
+
+// Username is the user of the last batch request.
+func (s *lfsServer) Username() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.username
+}
+
+func TestLFS(t *testing.T) {
+	server := newLFSServer(t)
+	remote := newTestRemote(t)
+	excluded := server.Pointer("excluded")
+	untracked := server.Pointer("untracked")
+	remote.Commit(map[string]string{
+		".gitattributes":  "*.bin filter=lfs diff=lfs merge=lfs -text\n",
+		"model.bin":       server.Pointer("model v1"),
+		"docs/manual.bin": excluded,
+		"untracked.txt":   untracked,
+	})
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.Auth.Username = "git"
+	opts.Auth.Password = "secret"
+	opts.LFS = LFSOptions{Enabled: true, URL: server.URL, Exclude: []string{"docs"}}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "model.bin"), "model v1")
+	requireContent(t, filepath.Join(path, "docs", "manual.bin"), excluded)
+	requireContent(t, filepath.Join(path, "untracked.txt"), untracked)
+	require.Equal(t, 1, server.Downloads())
+	require.Equal(t, "git", server.Username())
+	require.DirExists(t, filepath.Join(path, ".git", "lfs", "objects"))
+
+	// Unchanged and locally modified files are checked out from the cache.
+	require.NoError(t, s.ForceSync())
+	require.NoError(t, os.WriteFile(filepath.Join(path, "model.bin"), []byte("modified"), 0o600))
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "model.bin"), "model v1")
+	require.Equal(t, 1, server.Downloads())
+
+	remote.Commit(map[string]string{"model.bin": server.Pointer("model v2")})
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "model.bin"), "model v2")
+	require.Equal(t, 2, server.Downloads())
+}
+
+func TestLFSUpdate(t *testing.T) {
+	server := newLFSServer(t)
+	remote := newTestRemote(t)
+	remote.Commit(map[string]string{
+		".gitattributes": "*.bin filter=lfs\n",
+		"a.bin":          server.Pointer("a v1"),
+		"b.bin":          server.Pointer("b"),
+		"c.dat":          server.Pointer("c"),
+	})
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.LFS = LFSOptions{Enabled: true, URL: server.URL}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "b.bin"), "b")
+	require.Equal(t, 1, server.Batches())
+
+	// Only the pointers of changed files are read, so the object of b.bin
+	// is not missed.
+	require.NoError(t, os.RemoveAll(opts.lfsCacheDir()))
+	remote.Commit(map[string]string{"a.bin": server.Pointer("a v2")})
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "a.bin"), "a v2")
+	requireContent(t, filepath.Join(path, "b.bin"), "b")
+	require.Equal(t, 2, server.Batches())
+	require.Equal(t, 3, server.Downloads())
+
+	remote.Commit(map[string]string{"README.md": "changed"})
+	require.NoError(t, s.ForceSync())
+	require.Equal(t, 2, server.Batches())
+
+	// A changed .gitattributes file reads every pointer again.
+	remote.Commit(map[string]string{".gitattributes": "*.bin filter=lfs\n*.dat filter=lfs\n"})
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "c.dat"), "c")
+	requireContent(t, filepath.Join(path, "b.bin"), "b")
+	require.Equal(t, 3, server.Batches())
+}
+
+func TestLFSPublish(t *testing.T) {
+	server := newLFSServer(t)
+	remote := newTestRemote(t)
+	remote.Commit(map[string]string{
+		".gitattributes":        "*.bin filter=lfs\n",
+		"models/.gitattributes": "large.bin -filter\n",
+		"models/small.bin":      server.Pointer("small"),
+		"models/large.bin":      server.Pointer("large"),
+	})
+
+	root := t.TempDir()
+	opts := remote.Options(filepath.Join(root, "current"))
+	opts.Publish = PublishOptions{Root: filepath.Join(root, "revs")}
+	opts.LFS = LFSOptions{Enabled: true, URL: server.URL, CacheDir: filepath.Join(root, "lfs")}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(opts.Path, "models", "small.bin"), "small")
+	content, err := os.ReadFile(filepath.Join(opts.Path, "models", "large.bin"))
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(string(content), "version "), "the nested .gitattributes unsets the filter")
+	require.DirExists(t, opts.LFS.CacheDir)
+}
+
+func TestParseLFSPointer(t *testing.T) {
+	oid := strings.Repeat("ab", 32)
+	p, ok := parseLFSPointer([]byte("version " + lfsPointerVersion + "\noid sha256:" + oid + "\nsize 12\n"))
+	require.True(t, ok)
+	require.Equal(t, lfsPointer{OID: oid, Size: 12}, p)
+
+	for _, content := range []string{
+		"version " + lfsPointerVersion + "\noid sha256:1234\nsize 12\n",
+		"version " + lfsPointerVersion + "\noid sha256:" + oid + "\nsize -1\n",
+		"oid sha256:" + oid + "\nsize 12\nversion " + lfsPointerVersion + "\n",
+		"binary content",
+	} {
+		_, ok = parseLFSPointer([]byte(content))
+		require.False(t, ok, content)
+	}
+}
+
+func TestLFSURL(t *testing.T) {
+	for repo, expected := range map[string]string{
+		"https://github.com/org/app.git": "https://github.com/org/app.git/info/lfs",
+		"https://github.com/org/app":     "https://github.com/org/app.git/info/lfs",
+		"ssh://git@github.com/org/app":   "https://github.com/org/app.git/info/lfs",
+		"git@github.com:org/app.git":     "https://github.com/org/app.git/info/lfs",
+	} {
+		url, err := SyncOptions{Auth: AuthOptions{Repo: repo}}.lfsURL()
+		require.NoError(t, err)
+		require.Equal(t, expected, url, repo)
+	}
+
+	_, err := SyncOptions{Auth: AuthOptions{Repo: "/srv/git/app.git"}}.lfsURL()
+	require.Error(t, err)
+}
@@ -0,0 +1,268 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+var (
+	ErrSyncerExists   = errors.New("syncer already exists")
+	ErrSyncerNotFound = errors.New("syncer not found")
+)
+
+// Manager owns a named set of Syncers, starts and stops them together and
+// limits how many clone/fetch operations run at the same time.
+type Manager struct {
+	syncers map[string]*Syncer
+	// lock guards syncers and running. It is never held while a Syncer
+	// stops, which waits for its sync in progress.
+	lock sync.RWMutex
+	// changeLock serializes Apply, Remove, Stop and Shutdown.
+	changeLock sync.Mutex
+	limiter    chan struct{}
+	running    bool
+	// pending tracks the syncs started in the background by Apply.
+	pending sync.WaitGroup
+}
+
+// NewManager creates a Manager that allows at most maxConcurrent syncs to run
+// at once. A value of zero or less means no limit.
+func NewManager(maxConcurrent int) *Manager {
+	var limiter chan struct{}
+	if maxConcurrent > 0 {
+		limiter = make(chan struct{}, maxConcurrent)
+	}
+
+	return &Manager{
+		syncers: map[string]*Syncer{},
+		limiter: limiter,
+	}
+}
+
+// Add creates a Syncer for the options and registers it under name. If the
+// manager is already running the new Syncer is started right away.
+func (m *Manager) Add(name string, options SyncOptions) (*Syncer, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if _, ok := m.syncers[name]; ok {
+		return nil, fmt.Errorf("%w: %s", ErrSyncerExists, name)
+	}
+
+	return m.add(name, options), nil
+}
+
+func (m *Manager) add(name string, options SyncOptions) *Syncer {
+	s := NewSyncer(options)
+	s.limiter = m.limiter
+	s.name = name
+	m.syncers[name] = s
+
+	if m.running {
+		s.Start()
+	}
+	return s
+}
+
+// Remove stops the Syncer registered under name and forgets about it.
+func (m *Manager) Remove(name string) error {
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+
+	m.lock.Lock()
+	s, ok := m.syncers[name]
+	delete(m.syncers, name)
+	m.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrSyncerNotFound, name)
+	}
+
+	s.Stop()
+	deleteMetrics(name)
+	return nil
+}
+
+// Apply reconciles the registered Syncers with options, which maps names to
+// the desired options. Syncers that are not in options are removed, new ones
+// are added and those whose options changed are updated. Syncers whose
+// options did not change are left running untouched. When the manager is
+// running, added and updated Syncers are synced right away.
+func (m *Manager) Apply(options map[string]SyncOptions) {
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+
+	// The map changes under lock, the Syncers are stopped and updated after
+	// it is released, so that readers do not wait for a sync in progress.
+	m.lock.Lock()
+	removed := map[string]*Syncer{}
+	for name, s := range m.syncers {
+		if _, ok := options[name]; !ok {
+			log.Printf("Removing repo: %s", name)
+			removed[name] = s
+			delete(m.syncers, name)
+		}
+	}
+
+	updated := map[string]*Syncer{}
+	synced := map[string]*Syncer{}
+	for name, opts := range options {
+		s, ok := m.syncers[name]
+		switch {
+		case !ok:
+			log.Printf("Adding repo: %s", name)
+			s = m.add(name, opts)
+		case !reflect.DeepEqual(s.Options, opts):
+			log.Printf("Updating repo: %s", name)
+			updated[name] = s
+		default:
+			continue
+		}
+		synced[name] = s
+	}
+	if !m.running {
+		synced = nil
+	}
+	m.pending.Add(len(synced))
+	m.lock.Unlock()
+
+	for name, s := range removed {
+		s.Stop()
+		deleteMetrics(name)
+	}
+	for name, s := range updated {
+		s.Update(options[name])
+	}
+
+	for name, s := range synced {
+		go func() {
+			defer m.pending.Done()
+			if err := s.ForceSync(); err != nil {
+				log.Printf("Error Syncing Repo: %s\n%v", name, err)
+			}
+		}()
+	}
+}
+
+func (m *Manager) Get(name string) (*Syncer, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	s, ok := m.syncers[name]
+	return s, ok
+}
+
+// Names returns the registered names in sorted order.
+func (m *Manager) Names() []string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	names := make([]string, 0, len(m.syncers))
+	for name := range m.syncers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *Manager) Statuses() map[string]SyncStatus {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	statuses := make(map[string]SyncStatus, len(m.syncers))
+	for name, s := range m.syncers {
+		statuses[name] = s.Status()
+	}
+	return statuses
+}
+
+// Start starts polling on every registered Syncer.
+func (m *Manager) Start() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.running = true
+	for _, s := range m.syncers {
+		s.Start()
+	}
+}
+
+// Stop stops polling on every registered Syncer and waits for the syncs
+// started by Apply to return.
+func (m *Manager) Stop() {
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+
+	m.lock.Lock()
+	m.running = false
+	syncers := make([]*Syncer, 0, len(m.syncers))
+	for _, s := range m.syncers {
+		syncers = append(syncers, s)
+	}
+	m.lock.Unlock()
+
+	for _, s := range syncers {
+		s.Stop()
+	}
+	m.pending.Wait()
+}
+
+// Shutdown stops every registered Syncer, see Syncer.Shutdown, and waits for
+// the syncs started by Apply to return. It returns ctx.Err() when syncs had to
+// be canceled. A concurrent Apply waits for it, so it cannot add a Syncer
+// that is not shut down.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.changeLock.Lock()
+	defer m.changeLock.Unlock()
+
+	m.lock.Lock()
+	m.running = false
+	syncers := make([]*Syncer, 0, len(m.syncers))
+	for _, s := range m.syncers {
+		syncers = append(syncers, s)
+	}
+	m.lock.Unlock()
+
+	errs := make([]error, len(syncers))
+	var wg sync.WaitGroup
+	for i, s := range syncers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = s.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	m.pending.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func acquire(ctx context.Context, limiter chan struct{}) error {
+	if limiter == nil {
+		return nil
+	}
+
+	select {
+	case limiter <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func release(limiter chan struct{}) {
+	if limiter == nil {
+		return
+	}
+	<-limiter
+}
@@ -0,0 +1,192 @@
+package syncer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestManager(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+	m := NewManager(1)
+
+	a, err := m.Add("a", remote.Options(filepath.Join(root, "a")))
+	require.NoError(t, err)
+	b, err := m.Add("b", remote.Options(filepath.Join(root, "b")))
+	require.NoError(t, err)
+
+	_, err = m.Add("a", remote.Options(filepath.Join(root, "c")))
+	require.ErrorIs(t, err, ErrSyncerExists)
+
+	require.Equal(t, []string{"a", "b"}, m.Names())
+
+	require.NoError(t, a.ForceSync())
+	require.NoError(t, b.ForceSync())
+
+	statuses := m.Statuses()
+	require.Len(t, statuses, 2)
+	require.Equal(t, statuses["a"].LatestHash, statuses["b"].LatestHash)
+
+	m.Start()
+	m.Stop()
+
+	require.NoError(t, m.Remove("a"))
+	require.ErrorIs(t, m.Remove("a"), ErrSyncerNotFound)
+	_, ok := m.Get("a")
+	require.False(t, ok)
+
+	m.Start()
+	require.NoError(t, m.Shutdown(context.Background()))
+	require.ErrorIs(t, b.ForceSync(), ErrSyncerClosed)
+}
+
+func TestManagerLimitsFetches(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+	release := filepath.Join(root, "release")
+	m := NewManager(1)
+
+	// The hook of a blocks until b synced, which needs the only slot.
+	opts := remote.Options(filepath.Join(root, "a"))
+	opts.Hooks.PostSync = []Hook{{Command: []string{"sh", "-c", "while [ ! -f " + release + " ]; do sleep 0.01; done"}}}
+	a, err := m.Add("a", opts)
+	require.NoError(t, err)
+	b, err := m.Add("b", remote.Options(filepath.Join(root, "b")))
+	require.NoError(t, err)
+
+	errs := make(chan error, 1)
+	go func() { errs <- a.ForceSync() }()
+	require.Eventually(t, func() bool {
+		return a.Status().Phase == PhaseRunningHooks
+	}, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, b.ForceSync())
+	require.NoError(t, os.WriteFile(release, nil, 0o600))
+	require.NoError(t, <-errs)
+}
+
+func TestManagerApply(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+	m := NewManager(0)
+
+	a, err := m.Add("a", remote.Options(filepath.Join(root, "a")))
+	require.NoError(t, err)
+	b, err := m.Add("b", remote.Options(filepath.Join(root, "b")))
+	require.NoError(t, err)
+
+	m.Start()
+	defer m.Stop()
+
+	changed := remote.Options(filepath.Join(root, "b"))
+	changed.PollInterval = time.Minute
+	m.Apply(map[string]SyncOptions{
+		"a": remote.Options(filepath.Join(root, "a")),
+		"b": changed,
+		"c": remote.Options(filepath.Join(root, "c")),
+	})
+
+	require.Equal(t, []string{"a", "b", "c"}, m.Names())
+
+	gotA, _ := m.Get("a")
+	require.Same(t, a, gotA)
+	gotB, _ := m.Get("b")
+	require.Same(t, b, gotB)
+	require.Equal(t, time.Minute, b.Options.PollInterval)
+
+	m.Apply(map[string]SyncOptions{"c": remote.Options(filepath.Join(root, "c"))})
+	require.Equal(t, []string{"c"}, m.Names())
+}
+
+func TestManagerShutdownBlocksApply(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+	m := NewManager(0)
+
+	opts := remote.Options(filepath.Join(root, "a"))
+	opts.PollInterval = time.Millisecond
+	a, err := m.Add("a", opts)
+	require.NoError(t, err)
+
+	// Hold up the next poll of a, so the shutdown waits for it.
+	a.syncLock.Lock()
+	m.Start()
+	require.Eventually(t, func() bool {
+		a.statusLock.Lock()
+		defer a.statusLock.Unlock()
+		return a.queued != nil
+	}, 5*time.Second, time.Millisecond)
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- m.Shutdown(context.Background()) }()
+	require.Eventually(t, func() bool {
+		a.statusLock.Lock()
+		defer a.statusLock.Unlock()
+		return a.closed
+	}, 5*time.Second, time.Millisecond)
+
+	applied := make(chan struct{})
+	go func() {
+		defer close(applied)
+		m.Apply(map[string]SyncOptions{"a": opts, "b": remote.Options(filepath.Join(root, "b"))})
+	}()
+	select {
+	case <-applied:
+		t.Fatal("Apply returned during the shutdown")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	a.syncLock.Unlock()
+	require.NoError(t, <-shutdown)
+	<-applied
+	b, ok := m.Get("b")
+	require.True(t, ok)
+	require.Nil(t, b.pollingCancel, "a Syncer added after the shutdown is not started")
+}
+
+func TestManagerApplyDoesNotBlockReaders(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+	m := NewManager(0)
+
+	opts := remote.Options(filepath.Join(root, "a"))
+	opts.PollInterval = time.Millisecond
+	a, err := m.Add("a", opts)
+	require.NoError(t, err)
+	_, err = m.Add("b", remote.Options(filepath.Join(root, "b")))
+	require.NoError(t, err)
+
+	// Hold up the next poll of a, so stopping a waits for it.
+	a.syncLock.Lock()
+	m.Start()
+	defer m.Stop()
+	require.Eventually(t, func() bool {
+		a.statusLock.Lock()
+		defer a.statusLock.Unlock()
+		return a.queued != nil
+	}, 5*time.Second, time.Millisecond)
+
+	applied := make(chan struct{})
+	go func() {
+		defer close(applied)
+		m.Apply(map[string]SyncOptions{"b": remote.Options(filepath.Join(root, "b"))})
+	}()
+	require.Eventually(t, func() bool {
+		_, ok := m.Get("a")
+		return !ok
+	}, 5*time.Second, time.Millisecond)
+	require.Len(t, m.Statuses(), 1)
+
+	select {
+	case <-applied:
+		t.Fatal("Apply returned before the sync of the removed Syncer")
+	default:
+	}
+	a.syncLock.Unlock()
+	<-applied
+}
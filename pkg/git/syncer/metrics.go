@@ -0,0 +1,161 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	OperationClone   = "clone"
+	OperationFetch   = "fetch"
+	OperationPull    = "pull"
+	OperationReset   = "reset"
+	OperationPublish = "publish"
+	OperationLFS     = "lfs"
+	OperationBlobs   = "blobs"
+)
+
+var (
+	syncAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_sync_attempts_total",
+		Help: "Number of syncs started.",
+	}, []string{"repo"})
+	syncSuccesses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_sync_successes_total",
+		Help: "Number of syncs that succeeded.",
+	}, []string{"repo"})
+	syncFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_sync_failures_total",
+		Help: "Number of syncs that failed, by error class.",
+	}, []string{"repo", "class"})
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "git_sync_operation_duration_seconds",
+		Help:    "Duration of the clone, fetch, pull, reset, publish, LFS download and blob fetch operations.",
+		Buckets: []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"repo", "operation"})
+	lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "git_sync_last_success_timestamp_seconds",
+		Help: "Unix time of the last successful sync.",
+	}, []string{"repo"})
+	commitInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "git_sync_commit_info",
+		Help: "The commit currently synced. Always 1.",
+	}, []string{"repo", "commit"})
+	consecutiveFailures = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "git_sync_consecutive_failures",
+		Help: "Number of syncs that failed in a row.",
+	}, []string{"repo"})
+	receivedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_sync_partial_received_bytes_total",
+		Help: "Size of the packs received by the fetches and blob fetches of a partial clone.",
+	}, []string{"repo"})
+	fetchedBlobs = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "git_sync_partial_fetched_blobs_total",
+		Help: "Number of blobs a partial clone fetched for the files checked out.",
+	}, []string{"repo"})
+	skippedBlobs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "git_sync_partial_skipped_blobs",
+		Help: "Number of files of the synced commit whose content a partial clone left on the server.",
+	}, []string{"repo"})
+)
+
+// RegisterMetrics registers the sync metrics with the registerer. Every metric
+// has a repo label holding the name of the repo in the Manager.
+func RegisterMetrics(reg prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		syncAttempts, syncSuccesses, syncFailures, operationDuration, lastSuccess, commitInfo, consecutiveFailures,
+		receivedBytes, fetchedBlobs, skippedBlobs,
+	} {
+		if err := reg.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metricsName is the repo label of the Syncer. Syncers that are not part of
+// a Manager are labeled with their path.
+func (s *Syncer) metricsName() string {
+	if s.name != "" {
+		return s.name
+	}
+	return s.Options.Path
+}
+
+func (s *Syncer) observe(operation string, start time.Time) {
+	operationDuration.WithLabelValues(s.metricsName(), operation).Observe(time.Since(start).Seconds())
+}
+
+// recordSync updates the metrics for a finished sync.
+func (s *Syncer) recordSync(err error) {
+	name := s.metricsName()
+	syncAttempts.WithLabelValues(name).Inc()
+
+	consecutiveFailures.WithLabelValues(name).Set(float64(s.status.ConsecutiveFailures))
+	if s.Options.Filter != "" {
+		receivedBytes.WithLabelValues(name).Add(float64(s.status.Fetch.ReceivedBytes))
+		fetchedBlobs.WithLabelValues(name).Add(float64(s.status.Fetch.FetchedBlobs))
+		skippedBlobs.WithLabelValues(name).Set(float64(s.status.Fetch.SkippedBlobs))
+	}
+	if err != nil {
+		syncFailures.WithLabelValues(name, errorClass(err)).Inc()
+		return
+	}
+
+	syncSuccesses.WithLabelValues(name).Inc()
+	lastSuccess.WithLabelValues(name).SetToCurrentTime()
+	if s.status.LatestHash != "" {
+		commitInfo.DeletePartialMatch(prometheus.Labels{"repo": name})
+		commitInfo.WithLabelValues(name, s.status.LatestHash).Set(1)
+	}
+}
+
+// deleteMetrics removes the metrics of a repo that is no longer synced.
+func deleteMetrics(name string) {
+	labels := prometheus.Labels{"repo": name}
+	syncAttempts.DeletePartialMatch(labels)
+	syncSuccesses.DeletePartialMatch(labels)
+	syncFailures.DeletePartialMatch(labels)
+	operationDuration.DeletePartialMatch(labels)
+	lastSuccess.DeletePartialMatch(labels)
+	commitInfo.DeletePartialMatch(labels)
+	consecutiveFailures.DeletePartialMatch(labels)
+	receivedBytes.DeletePartialMatch(labels)
+	fetchedBlobs.DeletePartialMatch(labels)
+	skippedBlobs.DeletePartialMatch(labels)
+}
+
+// errorClass returns a short, low cardinality description of a sync error for
+// the failures metric.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, ErrAuthentication):
+		return "auth"
+	case errors.Is(err, ErrHostKeyMismatch):
+		return "host_key"
+	case errors.Is(err, transport.ErrRepositoryNotFound), errors.Is(err, transport.ErrEmptyRemoteRepository):
+		return "repository_not_found"
+	case errors.Is(err, ErrRefNotFound):
+		return "reference_not_found"
+	case errors.Is(err, ErrCommitNotFound):
+		return "commit_not_found"
+	case errors.Is(err, ErrHookFailed):
+		return "hook"
+	case errors.Is(err, ErrWorktreeCorrupt):
+		return "worktree_corrupt"
+	case errors.Is(err, ErrDiskFull):
+		return "disk_full"
+	case errors.Is(err, ErrNetworkUnreachable):
+		return "network"
+	default:
+		return "other"
+	}
+}
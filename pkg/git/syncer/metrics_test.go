@@ -0,0 +1,63 @@
+package syncer
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	remote := newTestRemote(t)
+	manager := NewManager(0)
+	s, err := manager.Add("metrics", remote.Options(filepath.Join(t.TempDir(), "repo")))
+	require.NoError(t, err)
+
+	require.NoError(t, s.ForceSync())
+	hash := remote.Commit(map[string]string{"README.md": "changed"})
+	require.NoError(t, s.ForceSync())
+
+	require.InDelta(t, 2, testutil.ToFloat64(syncAttempts.WithLabelValues("metrics")), 0)
+	require.InDelta(t, 2, testutil.ToFloat64(syncSuccesses.WithLabelValues("metrics")), 0)
+	require.InDelta(t, 1, testutil.ToFloat64(commitInfo.WithLabelValues("metrics", hash)), 0)
+	require.Equal(t, 1, countSeries(t, commitInfo, "metrics"))
+	require.Positive(t, testutil.ToFloat64(lastSuccess.WithLabelValues("metrics")))
+	require.Equal(t, 3, countSeries(t, operationDuration, "metrics"),
+		"clone, fetch and pull")
+
+	s.Options.RefName = plumbing.NewBranchReferenceName("missing")
+	require.Error(t, s.ForceSync())
+	require.Error(t, s.ForceSync())
+	require.InDelta(t, 2, testutil.ToFloat64(syncFailures.WithLabelValues("metrics", "reference_not_found")), 0)
+	require.InDelta(t, 2, testutil.ToFloat64(consecutiveFailures.WithLabelValues("metrics")), 0)
+
+	require.NoError(t, manager.Remove("metrics"))
+	require.Zero(t, countSeries(t, syncAttempts, "metrics"))
+}
+
+// countSeries returns the number of series of the collector for the repo.
+func countSeries(t *testing.T, c prometheus.Collector, repo string) int {
+	t.Helper()
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		c.Collect(ch)
+		close(ch)
+	}()
+
+	count := 0
+	for m := range ch {
+		var metric dto.Metric
+		require.NoError(t, m.Write(&metric))
+		for _, label := range metric.GetLabel() {
+			if label.GetName() == "repo" && label.GetValue() == repo {
+				count++
+			}
+		}
+	}
+	return count
+}
@@ -0,0 +1,315 @@
+package syncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	EventSyncSucceeded = "sync.succeeded"
+	EventSyncFailed    = "sync.failed"
+	EventRefChanged    = "ref.changed"
+
+	// SignatureHeader carries "sha256=" followed by the hex HMAC-SHA256 of the
+	// body, keyed with the notification secret.
+	SignatureHeader = "X-Git-Sync-Signature"
+	EventHeader     = "X-Git-Sync-Event"
+
+	DefaultNotifyAttempts = 4
+	DefaultNotifyTimeout  = 10 * time.Second
+	DefaultNotifyBackoff  = time.Second
+
+	// maxNotifyBackoff caps the delay between two attempts.
+	maxNotifyBackoff = time.Minute
+	// maxDeliveries is the number of delivery results kept in the status.
+	maxDeliveries = 20
+)
+
+// Events lists every event a Notification can subscribe to.
+var Events = []string{EventSyncSucceeded, EventSyncFailed, EventRefChanged}
+
+// Notification is an HTTP endpoint that receives a POST for sync events.
+type Notification struct {
+	// Name identifies the notification in the status. Defaults to the URL.
+	Name string
+	URL  string
+	// Secret signs the body with HMAC-SHA256, see SignatureHeader. The body
+	// is not signed when both Secret and SecretFile are empty.
+	Secret     string
+	SecretFile string
+	// Events is the list of events to send. All events are sent when empty.
+	Events []string
+	// Template renders the JSON body from a NotificationEvent. The body is the
+	// JSON encoding of the event when empty.
+	Template string
+	// Timeout of a single attempt. Defaults to DefaultNotifyTimeout.
+	Timeout time.Duration
+	// MaxAttempts defaults to DefaultNotifyAttempts.
+	MaxAttempts int
+	// Backoff is the delay before the first retry, doubled after each
+	// attempt. Defaults to DefaultNotifyBackoff.
+	Backoff time.Duration
+}
+
+// NotificationEvent is the data a notification is rendered from.
+type NotificationEvent struct {
+	Event   string    `json:"event"`
+	Repo    string    `json:"repo"`
+	Path    string    `json:"path"`
+	Ref     string    `json:"ref"`
+	OldHash string    `json:"old_commit,omitempty"`
+	NewHash string    `json:"new_commit,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Time    time.Time `json:"time"`
+}
+
+type NotificationDelivery struct {
+	Name       string        `json:"name"`
+	Event      string        `json:"event"`
+	StartedAt  time.Time     `json:"started_at"`
+	Duration   time.Duration `json:"duration"`
+	Attempts   int           `json:"attempts"`
+	StatusCode int           `json:"status_code,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// ParseNotificationTemplate parses a Notification Template. The json function
+// is available to encode values, e.g. {"text": {{json .NewHash}}}.
+func ParseNotificationTemplate(text string) (*template.Template, error) {
+	return template.New("notification").Funcs(template.FuncMap{
+		"json": func(v any) (string, error) {
+			b, err := json.Marshal(v)
+			return string(b), err
+		},
+	}).Option("missingkey=error").Parse(text)
+}
+
+// Wants reports whether the notification subscribes to the event.
+func (n Notification) Wants(event string) bool {
+	return len(n.Events) == 0 || slices.Contains(n.Events, event)
+}
+
+// notify sends the events of a finished sync to the notifications in the
+// background. change is the commit change the sync applied, if any.
+func (s *Syncer) notify(change *hookEvent, syncErr error) {
+	if len(s.Options.Notifications) == 0 {
+		return
+	}
+
+	ref := s.status.ResolvedRef
+	if ref == "" {
+		ref = s.Options.RefName.String()
+	}
+	base := NotificationEvent{
+		Repo: s.Options.Auth.Repo,
+		Path: s.Options.Path,
+		Ref:  ref,
+		Time: time.Now(),
+	}
+
+	var events []NotificationEvent
+	if syncErr != nil {
+		e := base
+		e.Event = EventSyncFailed
+		e.NewHash = s.status.LatestHash
+		e.Error = syncErr.Error()
+		events = append(events, e)
+	} else {
+		e := base
+		e.Event = EventSyncSucceeded
+		e.NewHash = s.status.LatestHash
+		events = append(events, e)
+
+		if change != nil {
+			e.Event = EventRefChanged
+			if !change.OldHash.IsZero() {
+				e.OldHash = change.OldHash.String()
+			}
+			e.NewHash = change.NewHash.String()
+			events = append(events, e)
+		}
+	}
+
+	for _, n := range s.Options.Notifications {
+		for _, e := range events {
+			if n.Wants(e.Event) {
+				s.delivering.Add(1)
+				go func() {
+					defer s.delivering.Done()
+					s.deliver(s.deliveryCtx, n, e)
+				}()
+			}
+		}
+	}
+}
+
+// waitDeliveries waits for the notification deliveries in progress. If ctx is
+// done first they are canceled, and ctx.Err() is returned once they returned.
+func (s *Syncer) waitDeliveries(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.delivering.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+	}
+	s.deliveryCancel()
+	<-done
+	return ctx.Err()
+}
+
+// deliver posts the event to the notification, retrying with exponential
+// backoff until ctx is done, and records the result.
+func (s *Syncer) deliver(ctx context.Context, n Notification, event NotificationEvent) {
+	result := NotificationDelivery{
+		Name:      n.Name,
+		Event:     event.Event,
+		StartedAt: time.Now(),
+	}
+	if result.Name == "" {
+		result.Name = n.URL
+	}
+
+	err := s.post(ctx, n, event, &result)
+	result.Duration = time.Since(result.StartedAt)
+	if err != nil {
+		result.Error = err.Error()
+		log.Printf("Notification %s for %s failed after %d attempts: %v", result.Name, event.Event, result.Attempts, err)
+	}
+
+	s.deliveriesLock.Lock()
+	defer s.deliveriesLock.Unlock()
+	s.deliveries = append(s.deliveries, result)
+	if len(s.deliveries) > maxDeliveries {
+		s.deliveries = s.deliveries[len(s.deliveries)-maxDeliveries:]
+	}
+}
+
+// errPermanent marks delivery errors that are not worth retrying.
+var errPermanent = errors.New("permanent failure")
+
+func (s *Syncer) post(ctx context.Context, n Notification, event NotificationEvent, result *NotificationDelivery) error {
+	body, err := notificationBody(n, event)
+	if err != nil {
+		return err
+	}
+
+	signature, err := notificationSignature(n, body)
+	if err != nil {
+		return err
+	}
+
+	attempts := n.MaxAttempts
+	if attempts <= 0 {
+		attempts = DefaultNotifyAttempts
+	}
+	backoff := n.Backoff
+	if backoff <= 0 {
+		backoff = DefaultNotifyBackoff
+	}
+	timeout := n.Timeout
+	if timeout <= 0 {
+		timeout = DefaultNotifyTimeout
+	}
+	client := &http.Client{Timeout: timeout}
+
+	for {
+		result.Attempts++
+		result.StatusCode, err = postOnce(ctx, client, n.URL, event.Event, signature, body)
+		if err == nil || errors.Is(err, errPermanent) || result.Attempts >= attempts || ctx.Err() != nil {
+			return err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+		backoff = min(2*backoff, maxNotifyBackoff)
+	}
+}
+
+func postOnce(ctx context.Context, client *http.Client, url string, event string, signature string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("%w: %w", errPermanent, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event)
+	if signature != "" {
+		req.Header.Set(SignatureHeader, signature)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return resp.StatusCode, nil
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout:
+		return resp.StatusCode, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return resp.StatusCode, fmt.Errorf("%w: unexpected status %s", errPermanent, resp.Status)
+	}
+}
+
+func notificationBody(n Notification, event NotificationEvent) ([]byte, error) {
+	if n.Template == "" {
+		return json.Marshal(event)
+	}
+
+	tmpl, err := ParseNotificationTemplate(n.Template)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, event); err != nil {
+		return nil, err
+	}
+	if !json.Valid(buf.Bytes()) {
+		return nil, errors.New("template did not render valid JSON")
+	}
+	return buf.Bytes(), nil
+}
+
+func notificationSignature(n Notification, body []byte) (string, error) {
+	secret := n.Secret
+	if secret == "" && n.SecretFile != "" {
+		b, err := os.ReadFile(n.SecretFile)
+		if err != nil {
+			return "", err
+		}
+		secret = strings.TrimSpace(string(b))
+	}
+	if secret == "" {
+		return "", nil
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil)), nil
+}
@@ -0,0 +1,226 @@
+package syncer
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type notificationServer struct {
+	*httptest.Server
+
+	lock     sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	// failures is the number of requests answered with a 503 before
+	// succeeding.
+	failures int
+}
+
+func newNotificationServer(t *testing.T) *notificationServer {
+	t.Helper()
+
+	ns := &notificationServer{}
+	ns.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		ns.lock.Lock()
+		defer ns.lock.Unlock()
+		ns.requests = append(ns.requests, r)
+		ns.bodies = append(ns.bodies, body)
+		if ns.failures > 0 {
+			ns.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(ns.Close)
+	return ns
+}
+
+func (ns *notificationServer) Received() int {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	return len(ns.requests)
+}
+
+func (ns *notificationServer) Request(i int) (*http.Request, []byte) {
+	ns.lock.Lock()
+	defer ns.lock.Unlock()
+	return ns.requests[i], ns.bodies[i]
+}
+
+func requireDeliveries(t *testing.T, s *Syncer, count int) []NotificationDelivery {
+	t.Helper()
+
+	require.Eventually(t, func() bool {
+		return len(s.Status().Notifications) == count
+	}, 5*time.Second, 10*time.Millisecond)
+	return s.Status().Notifications
+}
+
+func TestNotify(t *testing.T) {
+	remote := newTestRemote(t)
+	ns := newNotificationServer(t)
+
+	opts := remote.Options(filepath.Join(t.TempDir(), "repo"))
+	opts.Notifications = []Notification{{
+		Name:   "deploy",
+		URL:    ns.URL,
+		Secret: "s3cret",
+		Events: []string{EventRefChanged},
+	}}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	first := s.Status().LatestHash
+	requireDeliveries(t, s, 1)
+
+	// Nothing changed, so there is no ref.changed event.
+	require.NoError(t, s.ForceSync())
+
+	second := remote.Commit(map[string]string{"README.md": "second"})
+	require.NoError(t, s.ForceSync())
+	deliveries := requireDeliveries(t, s, 2)
+	require.Equal(t, 2, ns.Received())
+
+	require.Equal(t, "deploy", deliveries[1].Name)
+	require.Equal(t, EventRefChanged, deliveries[1].Event)
+	require.Equal(t, 1, deliveries[1].Attempts)
+	require.Equal(t, http.StatusOK, deliveries[1].StatusCode)
+
+	req, body := ns.Request(1)
+	require.Equal(t, EventRefChanged, req.Header.Get(EventHeader))
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	require.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), req.Header.Get(SignatureHeader))
+
+	var event NotificationEvent
+	require.NoError(t, json.Unmarshal(body, &event))
+	require.Equal(t, EventRefChanged, event.Event)
+	require.Equal(t, first, event.OldHash)
+	require.Equal(t, second, event.NewHash)
+	require.Equal(t, "refs/heads/main", event.Ref)
+}
+
+func TestNotifyTemplate(t *testing.T) {
+	remote := newTestRemote(t)
+	ns := newNotificationServer(t)
+
+	opts := remote.Options(filepath.Join(t.TempDir(), "repo"))
+	opts.Notifications = []Notification{{
+		URL:      ns.URL,
+		Events:   []string{EventSyncSucceeded},
+		Template: `{"text": {{json (printf "%s synced %s" .Path .NewHash)}}}`,
+	}}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireDeliveries(t, s, 1)
+
+	req, body := ns.Request(0)
+	require.JSONEq(t, `{"text": "`+opts.Path+` synced `+s.Status().LatestHash+`"}`, string(body))
+	require.Empty(t, req.Header.Get(SignatureHeader))
+}
+
+func TestNotifyRetry(t *testing.T) {
+	remote := newTestRemote(t)
+	ns := newNotificationServer(t)
+	ns.failures = 2
+
+	opts := remote.Options(filepath.Join(t.TempDir(), "repo"))
+	opts.Notifications = []Notification{{
+		URL:     ns.URL,
+		Events:  []string{EventSyncSucceeded},
+		Backoff: time.Millisecond,
+	}}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	deliveries := requireDeliveries(t, s, 1)
+	require.Equal(t, 3, deliveries[0].Attempts)
+	require.Equal(t, http.StatusOK, deliveries[0].StatusCode)
+	require.Empty(t, deliveries[0].Error)
+
+	// Give up after MaxAttempts.
+	ns.lock.Lock()
+	ns.failures = 10
+	ns.lock.Unlock()
+	s.Options.Notifications[0].MaxAttempts = 2
+
+	require.NoError(t, s.ForceSync())
+	deliveries = requireDeliveries(t, s, 2)
+	require.Equal(t, 2, deliveries[1].Attempts)
+	require.Equal(t, http.StatusServiceUnavailable, deliveries[1].StatusCode)
+	require.Contains(t, deliveries[1].Error, "503")
+}
+
+func TestShutdownWaitsForDeliveries(t *testing.T) {
+	remote := newTestRemote(t)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	opts := remote.Options(filepath.Join(t.TempDir(), "repo"))
+	opts.Notifications = []Notification{{
+		URL:    server.URL,
+		Events: []string{EventSyncSucceeded},
+	}}
+	s := NewSyncer(opts)
+	require.NoError(t, s.ForceSync())
+
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(context.Background()) }()
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown returned before the delivery finished: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	require.NoError(t, <-done)
+	deliveries := s.Status().Notifications
+	require.Len(t, deliveries, 1)
+	require.Empty(t, deliveries[0].Error)
+}
+
+func TestShutdownCancelsDeliveries(t *testing.T) {
+	remote := newTestRemote(t)
+	ns := newNotificationServer(t)
+	ns.failures = 10
+
+	opts := remote.Options(filepath.Join(t.TempDir(), "repo"))
+	opts.Notifications = []Notification{{
+		URL:     ns.URL,
+		Events:  []string{EventSyncSucceeded},
+		Backoff: time.Hour,
+	}}
+	s := NewSyncer(opts)
+	require.NoError(t, s.ForceSync())
+	require.Eventually(t, func() bool { return ns.Received() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// The retry waiting for the backoff is given up when the shutdown times
+	// out.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	deliveries := s.Status().Notifications
+	require.Len(t, deliveries, 1)
+	require.Equal(t, 1, deliveries[0].Attempts)
+	require.Contains(t, deliveries[0].Error, "503")
+}
@@ -0,0 +1,565 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-billy/v5/util"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	formatcfg "github.com/go-git/go-git/v5/plumbing/format/config"
+	"github.com/go-git/go-git/v5/plumbing/format/packfile"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/capability"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+)
+
+// FetchStats describe the objects transferred for a partial clone, see
+// SyncOptions.Filter.
+type FetchStats struct {
+	// ReceivedBytes is the size of the packs received by the last sync, for
+	// the fetch and for the blobs fetched afterwards.
+	ReceivedBytes int64 `json:"received_bytes"`
+	// FetchedBlobs is the number of blobs the last sync fetched for the
+	// files it checked out.
+	FetchedBlobs int `json:"fetched_blobs"`
+	// SkippedBlobs is the number of files of the synced commit that are not
+	// checked out and whose content was left on the server.
+	SkippedBlobs int `json:"skipped_blobs"`
+}
+
+// ParseFilter parses a partial clone filter, blob:none or blob:limit=<n>
+// with an optional k, m or g suffix, like git clone --filter accepts.
+func ParseFilter(spec string) (packp.Filter, error) {
+	if spec == "blob:none" {
+		return packp.FilterBlobNone(), nil
+	}
+
+	limit, ok := strings.CutPrefix(spec, "blob:limit=")
+	if !ok {
+		return "", fmt.Errorf("unsupported filter %q, use blob:none or blob:limit=<n>[k|m|g]", spec)
+	}
+	prefix, number := packp.BlobLimitPrefixNone, limit
+	if i := len(limit) - 1; i > 0 {
+		switch strings.ToLower(limit[i:]) {
+		case "k":
+			prefix, number = packp.BlobLimitPrefixKibi, limit[:i]
+		case "m":
+			prefix, number = packp.BlobLimitPrefixMebi, limit[:i]
+		case "g":
+			prefix, number = packp.BlobLimitPrefixGibi, limit[:i]
+		}
+	}
+	n, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("invalid filter %q: the limit must be a size in bytes", spec)
+	}
+	return packp.FilterBlobLimit(n, prefix), nil
+}
+
+// clonePartial clones the repository like cloneRepo, fetching it with the
+// filter of the options. The worktree is left for the first sync to check
+// out.
+func clonePartial(ctx context.Context, opts SyncOptions, stats *FetchStats) (repo *git.Repository, err error) {
+	repo, err = git.PlainInit(opts.repoPath(), false)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// Like go-git, leave nothing behind that looks like a clone.
+		if err != nil {
+			_ = os.RemoveAll(filepath.Join(opts.repoPath(), git.GitDirName))
+		}
+	}()
+
+	if _, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{opts.Auth.Repo}}); err != nil {
+		return nil, err
+	}
+	err = fetchPartial(ctx, repo, opts, opts.Depth, stats)
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, err
+	}
+
+	// Tags and semver refs are checked out by commit, HEAD follows a branch
+	// once the sync checks it out.
+	if opts.RefName.IsBranch() {
+		return repo, repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, opts.RefName))
+	}
+	_, hash, err := resolveRemote(repo, opts)
+	if err != nil {
+		return nil, err
+	}
+	return repo, repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, hash))
+}
+
+// fetchPartial fetches the branches and tags of the remote like fetchRepo,
+// asking the server to leave out the blobs matched by the filter of the
+// options. Servers that cannot filter, or cannot send the blobs left out
+// later, send every blob.
+func fetchPartial(ctx context.Context, repo *git.Repository, opts SyncOptions, depth int, stats *FetchStats) (err error) {
+	filter, err := ParseFilter(opts.Filter)
+	if err != nil {
+		return err
+	}
+
+	session, err := newUploadPackSession(opts)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	ar, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return err
+	}
+	remoteRefs, err := ar.AllReferences()
+	if err != nil {
+		return err
+	}
+	if len(remoteRefs) == 0 {
+		return transport.ErrEmptyRemoteRepository
+	}
+
+	// The local references the branches and tags of the remote are fetched
+	// into, like by the refspecs of fetchRepo.
+	refs := map[plumbing.ReferenceName]plumbing.Hash{}
+	for name, ref := range remoteRefs {
+		switch {
+		case ref.Type() != plumbing.HashReference:
+		case name.IsBranch():
+			refs[plumbing.NewRemoteReferenceName("origin", name.Short())] = ref.Hash()
+		case name.IsTag():
+			refs[name] = ref.Hash()
+		}
+	}
+
+	// Like for go-git, a shallow clone that is deepened wants the commits it
+	// has already.
+	shallows, err := repo.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+	deepen := depth != 1 && len(shallows) > 0
+	wants := map[plumbing.Hash]bool{}
+	for _, hash := range refs {
+		if deepen || !hasObject(repo, hash) {
+			wants[hash] = true
+		}
+	}
+
+	if len(wants) > 0 {
+		req, err := newUploadPackRequest(ar)
+		if err != nil {
+			return err
+		}
+		for hash := range wants {
+			req.Wants = append(req.Wants, hash)
+		}
+		if req.Haves, err = localHaves(repo); err != nil {
+			return err
+		}
+		if depth != 0 {
+			req.Depth = packp.DepthCommits(depth)
+			req.Shallows = shallows
+			if err = req.Capabilities.Set(capability.Shallow); err != nil {
+				return err
+			}
+		}
+
+		// The blobs left out are fetched by hash when they are checked out,
+		// which the server has to allow.
+		filtered := ar.Capabilities.Supports(capability.Filter) && ar.Capabilities.Supports(capability.AllowReachableSHA1InWant)
+		if filtered {
+			req.Filter = filter
+			if err = req.Capabilities.Set(capability.Filter); err != nil {
+				return err
+			}
+		} else {
+			log.Printf("The server does not support partial clones, fetching every blob")
+		}
+
+		n, err := receivePack(ctx, repo, session, req, filtered)
+		stats.ReceivedBytes += n
+		if err != nil {
+			return err
+		}
+		if filtered && !isPartialClone(repo) {
+			if err = markPartialClone(repo, filter); err != nil {
+				return err
+			}
+		}
+	}
+
+	return updateRemoteRefs(repo, refs, len(wants) > 0)
+}
+
+// updateRemoteRefs points the local references at the fetched commits and
+// prunes the remote tracking references of branches that are gone. It
+// returns git.NoErrAlreadyUpToDate when nothing changed.
+func updateRemoteRefs(repo *git.Repository, refs map[plumbing.ReferenceName]plumbing.Hash, fetched bool) error {
+	updated := fetched
+	for name, hash := range refs {
+		if ref, err := repo.Storer.Reference(name); err == nil && ref.Hash() == hash {
+			continue
+		}
+		if err := repo.Storer.SetReference(plumbing.NewHashReference(name, hash)); err != nil {
+			return err
+		}
+		updated = true
+	}
+
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return err
+	}
+	var gone []plumbing.ReferenceName
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if _, ok := refs[ref.Name()]; !ok && strings.HasPrefix(ref.Name().String(), "refs/remotes/origin/") {
+			gone = append(gone, ref.Name())
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, name := range gone {
+		if err = repo.Storer.RemoveReference(name); err != nil {
+			return err
+		}
+		updated = true
+	}
+
+	if !updated {
+		return git.NoErrAlreadyUpToDate
+	}
+	return nil
+}
+
+// localHaves returns the commits of the local references, which the server
+// leaves out of the pack.
+func localHaves(repo *git.Repository) ([]plumbing.Hash, error) {
+	iter, err := repo.Storer.IterReferences()
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+
+	seen := map[plumbing.Hash]bool{}
+	var haves []plumbing.Hash
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		hash := ref.Hash()
+		if ref.Type() != plumbing.HashReference || seen[hash] || !hasObject(repo, hash) {
+			return nil
+		}
+		seen[hash] = true
+		haves = append(haves, hash)
+		return nil
+	})
+	return haves, err
+}
+
+// fetchBlobs fetches the blobs the filter of a partial clone left on the
+// server. It returns the size of the pack received.
+func fetchBlobs(ctx context.Context, repo *git.Repository, opts SyncOptions, blobs []plumbing.Hash) (n int64, err error) {
+	session, err := newUploadPackSession(opts)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if closeErr := session.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	ar, err := session.AdvertisedReferencesContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	req, err := newUploadPackRequest(ar)
+	if err != nil {
+		return 0, err
+	}
+	req.Wants = blobs
+	if n, err = receivePack(ctx, repo, session, req, true); err != nil {
+		return n, err
+	}
+
+	for _, hash := range blobs {
+		if !hasObject(repo, hash) {
+			return n, fmt.Errorf("the server did not send blob %s", hash)
+		}
+	}
+	return n, nil
+}
+
+// newUploadPackRequest returns a request for the capabilities the server
+// advertised, without progress messages.
+func newUploadPackRequest(ar *packp.AdvRefs) (*packp.UploadPackRequest, error) {
+	req := packp.NewUploadPackRequestFromCapabilities(ar.Capabilities)
+	if ar.Capabilities.Supports(capability.NoProgress) {
+		if err := req.Capabilities.Set(capability.NoProgress); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// receivePack sends the request and stores the objects of the pack the
+// server responds with. It returns the size of the response. A promisor pack
+// is marked as such, like git does for the packs of a partial clone, so that
+// git gc and fsck accept the blobs it refers to but lacks.
+func receivePack(ctx context.Context, repo *git.Repository, session transport.UploadPackSession, req *packp.UploadPackRequest, promisor bool) (int64, error) {
+	fs, ok := repo.Storer.(*filesystem.Storage)
+	if !ok {
+		return 0, errors.New("partial clones need a repository on disk")
+	}
+	before, err := fs.ObjectPacks()
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := session.UploadPack(ctx, req)
+	if errors.Is(err, transport.ErrEmptyUploadPackRequest) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Close()
+
+	if !req.Depth.IsZero() && len(resp.Shallows) > 0 {
+		if err = updateShallows(repo, resp.Shallows); err != nil {
+			return 0, err
+		}
+	}
+
+	counter := &countingReader{r: resp}
+	var pack io.Reader = counter
+	switch {
+	case req.Capabilities.Supports(capability.Sideband64k):
+		pack = sideband.NewDemuxer(sideband.Sideband64k, counter)
+	case req.Capabilities.Supports(capability.Sideband):
+		pack = sideband.NewDemuxer(sideband.Sideband, counter)
+	}
+	if err = packfile.UpdateObjectStorage(repo.Storer, pack); err != nil || !promisor {
+		return counter.n, err
+	}
+
+	after, err := fs.ObjectPacks()
+	if err != nil {
+		return counter.n, err
+	}
+	for _, hash := range after {
+		if slices.Contains(before, hash) {
+			continue
+		}
+		name := fs.Filesystem().Join("objects", "pack", "pack-"+hash.String()+".promisor")
+		if err = util.WriteFile(fs.Filesystem(), name, nil, 0o644); err != nil {
+			return counter.n, err
+		}
+	}
+	return counter.n, nil
+}
+
+// updateShallows adds the commits the server made shallow to the shallow
+// file, like go-git does.
+func updateShallows(repo *git.Repository, shallows []plumbing.Hash) error {
+	current, err := repo.Storer.Shallow()
+	if err != nil {
+		return err
+	}
+	for _, hash := range shallows {
+		if !slices.Contains(current, hash) {
+			current = append(current, hash)
+		}
+	}
+	return repo.Storer.SetShallow(current)
+}
+
+func newUploadPackSession(opts SyncOptions) (transport.UploadPackSession, error) {
+	auth, err := createAuthFromOpts(opts.Auth)
+	if err != nil {
+		return nil, err
+	}
+	caBundle, err := getCABundleFromFile(opts.CABuntleFile)
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint, err := transport.NewEndpoint(opts.Auth.Repo)
+	if err != nil {
+		return nil, err
+	}
+	endpoint.InsecureSkipTLS = opts.Auth.InsecureSkipTLS
+	endpoint.CaBundle = caBundle
+
+	c, err := client.NewClient(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return c.NewUploadPackSession(endpoint, auth)
+}
+
+// isPartialClone reports whether the repository was fetched with a filter,
+// so blobs may be missing from it.
+func isPartialClone(repo *git.Repository) bool {
+	cfg, err := repo.Config()
+	return err == nil && cfg.Raw.Section("remote").Subsection("origin").Option("promisor") == "true"
+}
+
+// markPartialClone records the filter in the configuration like git clone
+// --filter does, so git fetches the missing blobs for the commands run in
+// the worktree.
+func markPartialClone(repo *git.Repository, filter packp.Filter) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	cfg.Core.RepositoryFormatVersion = formatcfg.Version_1
+	if cfg.Extensions.ObjectFormat == "" {
+		cfg.Extensions.ObjectFormat = formatcfg.SHA1
+	}
+	cfg.Raw.Section("extensions").SetOption("partialclone", "origin")
+	origin := cfg.Raw.Section("remote").Subsection("origin")
+	origin.SetOption("promisor", "true")
+	origin.SetOption("partialclonefilter", string(filter))
+	return repo.SetConfig(cfg)
+}
+
+// fetchMissingBlobs fetches the blobs of a partial clone that the checkout
+// of the to tree reads. With a from tree, which the worktree was checked out
+// at, only the files changed since are looked at. It keeps count of the
+// files that are not checked out and whose blobs stay on the server.
+func (s *Syncer) fetchMissingBlobs(ctx context.Context, repo *git.Repository, from *object.Tree, to *object.Tree) error {
+	if !isPartialClone(repo) {
+		return nil
+	}
+
+	var files []object.TreeEntry
+	skipped := 0
+	if from == nil {
+		err := walkFiles(to, func(name string, entry object.TreeEntry) error {
+			entry.Name = name
+			files = append(files, entry)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	} else {
+		changes, err := object.DiffTreeWithOptions(ctx, from, to, nil)
+		if err != nil {
+			return err
+		}
+		skipped = s.status.Fetch.SkippedBlobs
+		for _, change := range changes {
+			if change.From.Name != "" && change.From.TreeEntry.Mode.IsFile() && !hasObject(repo, change.From.TreeEntry.Hash) {
+				skipped--
+			}
+			if change.To.Name != "" {
+				entry := change.To.TreeEntry
+				entry.Name = change.To.Name
+				files = append(files, entry)
+			}
+		}
+	}
+
+	seen := map[plumbing.Hash]bool{}
+	var blobs []plumbing.Hash
+	for _, f := range files {
+		if !f.Mode.IsFile() || hasObject(repo, f.Hash) {
+			continue
+		}
+		if !s.readsBlob(f.Name) {
+			skipped++
+			continue
+		}
+		if !seen[f.Hash] {
+			seen[f.Hash] = true
+			blobs = append(blobs, f.Hash)
+		}
+	}
+	s.status.Fetch.SkippedBlobs = max(skipped, 0)
+	if len(blobs) == 0 {
+		return nil
+	}
+
+	log.Printf("Fetching %d blobs of the partial clone...", len(blobs))
+	var n int64
+	err := s.download(ctx, OperationBlobs, func(ctx context.Context) error {
+		var err error
+		n, err = fetchBlobs(ctx, repo, s.Options, blobs)
+		return err
+	})
+	s.status.Fetch.ReceivedBytes += n
+	if err != nil {
+		return fmt.Errorf("failed to fetch blobs: %w", err)
+	}
+	s.status.Fetch.FetchedBlobs += len(blobs)
+	log.Printf("Fetched %d blobs, %d bytes. %d files are left on the server.", len(blobs), n, s.status.Fetch.SkippedBlobs)
+	return nil
+}
+
+// readsBlob reports whether the checkout reads the file: the sparse paths,
+// and the .gitattributes and .gitmodules files for LFS and submodules.
+func (s *Syncer) readsBlob(name string) bool {
+	switch {
+	case s.Options.Sparse.match(name):
+		return true
+	case s.Options.LFS.Enabled && path.Base(name) == ".gitattributes":
+		return true
+	default:
+		return s.Options.Submodules.Enabled && name == ".gitmodules"
+	}
+}
+
+// download runs fn, a download the checkout needs, in a sync slot within the
+// fetch timeout, and moves the sync back to checking out.
+func (s *Syncer) download(ctx context.Context, operation string, fn func(ctx context.Context) error) error {
+	if err := s.acquireSlot(ctx, PhaseFetching); err != nil {
+		return err
+	}
+	start := time.Now()
+	fetchCtx, cancel := phaseContext(ctx, s.Options.Timeouts.Fetch)
+	err := phaseError(fetchCtx, operation, s.Options.Timeouts.Fetch, fn(fetchCtx))
+	cancel()
+	release(s.limiter)
+	s.observe(operation, start)
+	s.setPhase(PhaseCheckingOut)
+	return err
+}
+
+func hasObject(repo *git.Repository, hash plumbing.Hash) bool {
+	return repo.Storer.HasEncodedObject(hash) == nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,171 @@
+package syncer
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/stretchr/testify/require"
+)
+
+// allowFilters serves the remote with git-upload-pack, which supports the
+// filters and the blob requests of partial clones once they are allowed.
+func allowFilters(t *testing.T, remote *testRemote) {
+	t.Helper()
+
+	useGitBinary(t)
+	for _, key := range []string{"uploadpack.allowFilter", "uploadpack.allowReachableSHA1InWant"} {
+		gitOutput(t, remote.Path, "config", key, "true")
+	}
+}
+
+// gitOutput runs git in the clone at path and returns its output.
+func gitOutput(t *testing.T, path string, args ...string) string {
+	t.Helper()
+
+	out, err := exec.Command("git", append([]string{"-C", path}, args...)...).CombinedOutput()
+	require.NoError(t, err, string(out))
+	return string(out)
+}
+
+// requireMissingBlob checks that the clone at path has no blob with the
+// content.
+func requireMissingBlob(t *testing.T, path string, content string) {
+	t.Helper()
+
+	repo, err := git.PlainOpen(path)
+	require.NoError(t, err)
+	hash := plumbing.ComputeHash(plumbing.BlobObject, []byte(content))
+	require.ErrorIs(t, repo.Storer.HasEncodedObject(hash), plumbing.ErrObjectNotFound)
+}
+
+func TestParseFilter(t *testing.T) {
+	for _, tc := range []struct {
+		spec     string
+		expected packp.Filter
+	}{
+		{"blob:none", "blob:none"},
+		{"blob:limit=0", "blob:limit=0"},
+		{"blob:limit=1024", "blob:limit=1024"},
+		{"blob:limit=1m", "blob:limit=1m"},
+		{"blob:limit=2K", "blob:limit=2k"},
+		{"blob:limit=1g", "blob:limit=1g"},
+	} {
+		filter, err := ParseFilter(tc.spec)
+		require.NoError(t, err, tc.spec)
+		require.Equal(t, tc.expected, filter)
+	}
+
+	for _, spec := range []string{"", "tree:0", "blob:limit=", "blob:limit=m", "blob:limit=1t", "blob:limit=-1"} {
+		_, err := ParseFilter(spec)
+		require.Error(t, err, spec)
+	}
+}
+
+func TestPartialClone(t *testing.T) {
+	remote := newTestRemote(t)
+	allowFilters(t, remote)
+	big := strings.Repeat("x", 4096)
+	remote.Commit(map[string]string{"app/config.yaml": "v1", "assets/big.bin": big})
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.Filter = "blob:none"
+	opts.Sparse = SparseOptions{Include: []string{"app"}}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "app", "config.yaml"), "v1")
+	require.NoFileExists(t, filepath.Join(path, "README.md"))
+	requireMissingBlob(t, path, big)
+	requireMissingBlob(t, path, "initial")
+	require.Empty(t, gitOutput(t, path, "status", "--porcelain"))
+	stats := s.Status().Fetch
+	require.Positive(t, stats.ReceivedBytes)
+	require.Equal(t, 1, stats.FetchedBlobs)
+	require.Equal(t, 2, stats.SkippedBlobs, "README.md and assets/big.bin")
+
+	// An update fetches the blobs of the changed files only.
+	big = strings.Repeat("y", 4096)
+	remote.Commit(map[string]string{"app/config.yaml": "v2", "app/new.yaml": "new", "assets/big.bin": big, "assets/small.txt": "small"})
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "app", "config.yaml"), "v2")
+	requireContent(t, filepath.Join(path, "app", "new.yaml"), "new")
+	requireMissingBlob(t, path, big)
+	require.Empty(t, gitOutput(t, path, "status", "--porcelain"))
+	stats = s.Status().Fetch
+	require.Equal(t, 2, stats.FetchedBlobs)
+	require.Equal(t, 3, stats.SkippedBlobs)
+
+	// A sync without changes fetches nothing.
+	require.NoError(t, s.ForceSync())
+	require.Equal(t, FetchStats{SkippedBlobs: 3}, s.Status().Fetch)
+
+	// git fetches the blobs left out when it needs them.
+	gitOutput(t, path, "fsck")
+	require.Equal(t, big, gitOutput(t, path, "show", "HEAD:assets/big.bin"))
+}
+
+func TestPartialCloneBlobLimit(t *testing.T) {
+	remote := newTestRemote(t)
+	allowFilters(t, remote)
+	big := strings.Repeat("x", 4096)
+	remote.Commit(map[string]string{"big.bin": big})
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.Filter = "blob:limit=1k"
+	s := NewSyncer(opts)
+
+	// Every file is checked out, the large one with a blob fetched for it.
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "big.bin"), big)
+	requireReadme(t, path, "initial")
+	require.Equal(t, FetchStats{ReceivedBytes: s.Status().Fetch.ReceivedBytes, FetchedBlobs: 1}, s.Status().Fetch)
+}
+
+func TestPartialClonePublish(t *testing.T) {
+	remote := newTestRemote(t)
+	allowFilters(t, remote)
+	big := strings.Repeat("x", 4096)
+	remote.Commit(map[string]string{"app/config.yaml": "v1", "assets/big.bin": big})
+
+	root := t.TempDir()
+	opts := remote.Options(filepath.Join(root, "current"))
+	opts.Publish = PublishOptions{Root: filepath.Join(root, "revs")}
+	opts.Filter = "blob:none"
+	opts.Sparse = SparseOptions{Include: []string{"app"}}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(opts.Path, "app", "config.yaml"), "v1")
+	require.NoFileExists(t, filepath.Join(opts.Path, "assets", "big.bin"))
+	requireMissingBlob(t, opts.repoPath(), big)
+	require.Equal(t, 2, s.Status().Fetch.SkippedBlobs)
+}
+
+func TestPartialCloneUnsupported(t *testing.T) {
+	remote := newTestRemote(t)
+	useGitBinary(t)
+	remote.Commit(map[string]string{"big.bin": strings.Repeat("x", 4096)})
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.Filter = "blob:none"
+	opts.Sparse = SparseOptions{Include: []string{"big.bin"}}
+	s := NewSyncer(opts)
+
+	// The server sends every blob, so there is nothing to fetch later.
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "big.bin"), strings.Repeat("x", 4096))
+	require.NoFileExists(t, filepath.Join(path, "README.md"))
+	repo, err := git.PlainOpen(path)
+	require.NoError(t, err)
+	require.False(t, isPartialClone(repo))
+	require.Zero(t, s.Status().Fetch.SkippedBlobs)
+	require.Zero(t, s.Status().Fetch.FetchedBlobs)
+}
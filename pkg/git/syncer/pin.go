@@ -0,0 +1,96 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+var (
+	ErrInvalidHash      = errors.New("invalid commit hash")
+	ErrNoPreviousCommit = errors.New("no previous commit")
+	ErrCommitNotFound   = errors.New("commit not found")
+)
+
+// Pin holds the worktree at the commit until Unpin is called. The repo keeps
+// being fetched while pinned so the status shows how far behind the remote
+// the pin is. The pin is applied right away and is discarded if that fails.
+func (s *Syncer) Pin(hash string) error {
+	if !plumbing.IsHash(hash) {
+		return fmt.Errorf("%w: %s", ErrInvalidHash, hash)
+	}
+
+	return s.setPin(hash)
+}
+
+// PinPrevious pins the commit that was synced before the current one.
+func (s *Syncer) PinPrevious() error {
+	previous := s.Status().PreviousHash
+	if previous == "" {
+		return ErrNoPreviousCommit
+	}
+
+	return s.setPin(previous)
+}
+
+// Unpin removes the pin and syncs the worktree to the tracked reference.
+func (s *Syncer) Unpin() error {
+	return s.setPin("")
+}
+
+func (s *Syncer) setPin(hash string) error {
+	s.syncLock.Lock()
+	previous := s.status.PinnedHash
+	s.status.PinnedHash = hash
+	s.publish()
+	s.syncLock.Unlock()
+
+	if hash == "" {
+		log.Printf("Unpinning Repo: %s", s.Options.Auth.Repo)
+	} else {
+		log.Printf("Pinning Repo %s at %s", s.Options.Auth.Repo, hash)
+	}
+
+	err := s.syncRepo(context.Background(), true)
+	if err != nil && hash != "" {
+		s.syncLock.Lock()
+		if s.status.PinnedHash == hash {
+			s.status.PinnedHash = previous
+			s.publish()
+			s.saveState()
+		}
+		s.syncLock.Unlock()
+	}
+	return err
+}
+
+// commitsBehind returns the number of commits in the history of remote before
+// pin is reached, or -1 when pin is not in that history.
+func commitsBehind(repo *git.Repository, remote plumbing.Hash, pin plumbing.Hash) int {
+	iter, err := repo.Log(&git.LogOptions{From: remote})
+	if err != nil {
+		return -1
+	}
+	defer iter.Close()
+
+	count := 0
+	found := false
+	err = iter.ForEach(func(c *object.Commit) error {
+		if c.Hash == pin {
+			found = true
+			return storer.ErrStop
+		}
+		count++
+		return nil
+	})
+	if err != nil || !found {
+		return -1
+	}
+	return count
+}
@@ -0,0 +1,73 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPin(t *testing.T) {
+	remote := newTestRemote(t)
+	path := filepath.Join(t.TempDir(), "repo")
+	s := NewSyncer(remote.Options(path))
+
+	require.NoError(t, s.ForceSync())
+	first := s.Status().LatestHash
+	second := remote.Commit(map[string]string{"README.md": "second"})
+	require.NoError(t, s.ForceSync())
+
+	require.ErrorIs(t, s.Pin("nope"), ErrInvalidHash)
+	require.ErrorIs(t, s.Pin("0123456789012345678901234567890123456789"), ErrCommitNotFound)
+	require.Empty(t, s.Status().PinnedHash)
+
+	require.NoError(t, s.PinPrevious())
+	requireReadme(t, path, "initial")
+
+	third := remote.Commit(map[string]string{"README.md": "third"})
+	require.NoError(t, s.ForceSync())
+	requireReadme(t, path, "initial")
+
+	status := s.Status()
+	require.Equal(t, first, status.PinnedHash)
+	require.Equal(t, first, status.LatestHash)
+	require.Equal(t, second, status.PreviousHash)
+	require.Equal(t, third, status.RemoteHash)
+	require.Equal(t, 2, status.CommitsBehind)
+
+	require.NoError(t, s.Unpin())
+	requireReadme(t, path, "third")
+	status = s.Status()
+	require.Empty(t, status.PinnedHash)
+	require.Equal(t, third, status.LatestHash)
+	require.Zero(t, status.CommitsBehind)
+}
+
+func TestPinPublish(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+
+	opts := remote.Options(filepath.Join(root, "current"))
+	opts.Publish = PublishOptions{Root: filepath.Join(root, "revs")}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	first := s.Status().LatestHash
+	remote.Commit(map[string]string{"README.md": "second"})
+	require.NoError(t, s.ForceSync())
+
+	require.NoError(t, s.Pin(first))
+	requirePublished(t, opts, first, "initial")
+
+	require.NoError(t, s.Unpin())
+	requireReadme(t, opts.Path, "second")
+}
+
+func requireReadme(t *testing.T, path string, readme string) {
+	t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(path, "README.md"))
+	require.NoError(t, err)
+	require.Equal(t, readme, string(content))
+}
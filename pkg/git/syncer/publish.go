@@ -0,0 +1,431 @@
+package syncer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	DefaultKeepRevisions = 3
+
+	publishRepoDir    = "repo"
+	revisionPrefix    = "rev-"
+	tmpRevisionPrefix = ".tmp-rev-"
+)
+
+var ErrUnsafePath = errors.New("unsafe path in tree")
+
+// PublishOptions configures the atomic publish mode. Instead of updating the
+// worktree at Path in place, the repository is kept in Root and every commit
+// is checked out into its own Root/rev-<hash> directory. Path is a symlink
+// that is atomically repointed to the current revision, so readers always see
+// a complete tree.
+type PublishOptions struct {
+	// Root enables the publish mode when set.
+	Root string
+	// KeepRevisions is the number of revisions kept on disk, including the
+	// current one. Defaults to DefaultKeepRevisions.
+	KeepRevisions int
+}
+
+func (o PublishOptions) Enabled() bool {
+	return o.Root != ""
+}
+
+// repoPath returns the directory the git repository lives in.
+func (o SyncOptions) repoPath() string {
+	if o.Publish.Enabled() {
+		return filepath.Join(o.Publish.Root, publishRepoDir)
+	}
+	return o.Path
+}
+
+// publishRevision checks out the commit into its revision directory, if it is
+// not there already, and points Path at it.
+func (s *Syncer) publishRevision(ctx context.Context, repo *git.Repository, hash plumbing.Hash, forcePull bool) error {
+	revDir, err := revisionPath(s.Options.Publish.Root, hash, s.Options.revisionKey())
+	if err != nil {
+		return err
+	}
+
+	current, _ := publishedRevision(s.Options.Path)
+	if !forcePull && hash.String() == s.status.LatestHash && current == revDir {
+		log.Println("No changes.")
+		return nil
+	}
+
+	if _, err = os.Stat(revDir); os.IsNotExist(err) {
+		log.Printf("Checking out revision %s", hash)
+		err = s.checkoutRevision(ctx, repo, hash, revDir)
+		if err != nil {
+			return fmt.Errorf("checkout revision failed: %w", err)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if current != revDir {
+		log.Printf("Publishing revision %s", hash)
+		err = swapSymlink(s.Options.Path, revDir)
+		if err != nil {
+			return fmt.Errorf("publish failed: %w", err)
+		}
+	}
+	// Revisions are pruned by the time they were last published, which a
+	// revision published again would not have otherwise.
+	now := time.Now()
+	if err = os.Chtimes(revDir, now, now); err != nil {
+		return err
+	}
+	s.setLatest(hash.String())
+
+	err = pruneRevisions(s.Options.Publish, revDir)
+	if err != nil {
+		log.Printf("Error removing old revisions: %v", err)
+	}
+	log.Println("Update Completed.")
+
+	return nil
+}
+
+// revisionPath returns the directory of the revision of the commit checked
+// out with the options identified by key, see SyncOptions.revisionKey.
+func revisionPath(root string, hash plumbing.Hash, key string) (string, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return "", err
+	}
+	name := revisionPrefix + hash.String()
+	if key != "" {
+		name += "-" + key
+	}
+	return filepath.Join(abs, name), nil
+}
+
+// revisionHash returns the commit of a revision directory name.
+func revisionHash(name string) (string, bool) {
+	rest, ok := strings.CutPrefix(name, revisionPrefix)
+	hash, _, _ := strings.Cut(rest, "-")
+	return hash, ok
+}
+
+// revisionKey identifies the options that decide which files a revision
+// holds, so that a revision checked out with other ones is not published
+// again. It is empty without sparse paths, LFS and submodules.
+func (o SyncOptions) revisionKey() string {
+	if !o.Sparse.Enabled() && !o.LFS.Enabled && !o.Submodules.Enabled {
+		return ""
+	}
+
+	var lfs, submodules any
+	if o.LFS.Enabled {
+		lfs = []any{o.LFS.Include, o.LFS.Exclude}
+	}
+	if o.Submodules.Enabled {
+		submodules = o.Submodules.MaxDepth
+	}
+	data, _ := json.Marshal([]any{o.Sparse.Include, o.Sparse.Exclude, lfs, submodules})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// publishedRevision returns the absolute revision directory the symlink at
+// path points to.
+func publishedRevision(path string) (string, error) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		return "", err
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	return filepath.Abs(target)
+}
+
+// checkoutRevision writes the tree of the commit, limited to the sparse
+// paths, and its submodules into a temporary directory below the publish root
+// and renames it to revDir once it is complete. It stops between two files
+// when ctx is done.
+func (s *Syncer) checkoutRevision(ctx context.Context, repo *git.Repository, hash plumbing.Hash, revDir string) error {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %w", ErrCommitNotFound, hash, err)
+	}
+
+	tmp, err := os.MkdirTemp(s.Options.Publish.Root, tmpRevisionPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	//nolint:gosec // published revisions are read by other processes
+	if err = os.Chmod(tmp, 0o755); err != nil {
+		return err
+	}
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+	if err = s.fetchMissingBlobs(ctx, repo, nil, tree); err != nil {
+		return err
+	}
+	lfs, err := s.prepareLFS(ctx, tree, nil, nil)
+	if err != nil {
+		return err
+	}
+	if err = writeTree(ctx, commit, s.Options.Sparse, lfs, tmp); err != nil {
+		return err
+	}
+	if err = s.updateSubmodules(ctx, repo, hash, tmp, false); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, revDir)
+}
+
+// writeTree writes the files of the commit selected by sparse into dir, with
+// the content of their LFS object for the pointer files in lfs.
+func writeTree(ctx context.Context, commit *object.Commit, sparse SparseOptions, lfs *lfsFiles, dir string) error {
+	tree, err := commit.Tree()
+	if err != nil {
+		return err
+	}
+
+	// The blobs of the files left out are not read, a partial clone may not
+	// have them.
+	return walkFiles(tree, func(name string, entry object.TreeEntry) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !sparse.match(name) {
+			return nil
+		}
+		f, err := treeFile(tree, name, entry)
+		if err != nil {
+			return err
+		}
+		return writeFile(f, dir, lfs)
+	})
+}
+
+// walkFiles calls fn for the files of the tree, like tree.Files, without
+// reading their blobs.
+func walkFiles(tree *object.Tree, fn func(name string, entry object.TreeEntry) error) error {
+	walker := object.NewTreeWalker(tree, true, nil)
+	defer walker.Close()
+	for {
+		name, entry, err := walker.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !entry.Mode.IsFile() {
+			continue
+		}
+		if err = fn(name, entry); err != nil {
+			return err
+		}
+	}
+}
+
+// treeFile reads the file of a tree entry found by walkFiles.
+func treeFile(tree *object.Tree, name string, entry object.TreeEntry) (*object.File, error) {
+	f, err := tree.TreeEntryFile(&entry)
+	if err != nil {
+		return nil, err
+	}
+	f.Name = name
+	return f, nil
+}
+
+func writeFile(f *object.File, dir string, lfs *lfsFiles) error {
+	if err := checkPath(f.Name); err != nil {
+		return err
+	}
+
+	target := filepath.Join(dir, filepath.FromSlash(f.Name))
+	//nolint:gosec // published revisions are read by other processes
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+
+	if f.Mode == filemode.Symlink {
+		link, err := f.Contents()
+		if err != nil {
+			return err
+		}
+		return os.Symlink(link, target)
+	}
+
+	reader, err := lfs.open(f)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, filePerm(f.Mode))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	if _, err = io.Copy(out, reader); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// checkPath returns ErrUnsafePath for a path from a tree that is absolute, has
+// a .. component or a .git component in any case. Like for go-git, such a
+// path must not be written, it could leave the directory or change the
+// repository.
+func checkPath(name string) error {
+	if !filepath.IsLocal(filepath.FromSlash(name)) {
+		return fmt.Errorf("%w: %s", ErrUnsafePath, name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." || strings.EqualFold(part, git.GitDirName) {
+			return fmt.Errorf("%w: %s", ErrUnsafePath, name)
+		}
+	}
+	return nil
+}
+
+// filePerm returns the permissions of a written file of the mode.
+func filePerm(mode filemode.FileMode) os.FileMode {
+	if mode == filemode.Executable {
+		return 0o755
+	}
+	return 0o644
+}
+
+// swapSymlink atomically points the symlink at path to target by renaming a
+// new symlink over it.
+func swapSymlink(path string, target string) error {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s exists and is not a symlink", path)
+	}
+
+	//nolint:gosec // published revisions are read by other processes
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Prefer a relative link so it still resolves when the volume is
+	// mounted at a different location in another container.
+	link := target
+	if rel, err := filepath.Rel(filepath.Dir(path), target); err == nil {
+		link = rel
+	}
+
+	tmp := path + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(link, tmp); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// pruneRevisions removes the oldest revision directories so that at most
+// KeepRevisions remain, never removing current. Leftovers of interrupted
+// checkouts are removed as well.
+func pruneRevisions(opts PublishOptions, current string) error {
+	keep := opts.KeepRevisions
+	if keep <= 0 {
+		keep = DefaultKeepRevisions
+	}
+
+	revisions, err := listRevisions(opts.Root)
+	if err != nil {
+		return err
+	}
+
+	kept := 1
+	var errs []error
+	for _, rev := range revisions {
+		if rev.Path == current {
+			continue
+		}
+		if kept < keep {
+			kept++
+			continue
+		}
+		log.Printf("Removing old revision %s", rev.Hash)
+		errs = append(errs, os.RemoveAll(rev.Path))
+	}
+
+	entries, err := os.ReadDir(opts.Root)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tmpRevisionPrefix) {
+			errs = append(errs, os.RemoveAll(filepath.Join(opts.Root, entry.Name())))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+type revision struct {
+	Hash    string
+	Path    string
+	ModTime time.Time
+}
+
+// listRevisions returns the revision directories below root, the one
+// published last first.
+func listRevisions(root string) ([]revision, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(abs)
+	if err != nil {
+		return nil, err
+	}
+
+	var revisions []revision
+	for _, entry := range entries {
+		hash, ok := revisionHash(entry.Name())
+		if !ok || !entry.IsDir() {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		revisions = append(revisions, revision{
+			Hash:    hash,
+			Path:    filepath.Join(abs, entry.Name()),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	sort.Slice(revisions, func(i, j int) bool {
+		return revisions[i].ModTime.After(revisions[j].ModTime)
+	})
+	return revisions, nil
+}
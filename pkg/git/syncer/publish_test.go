@@ -0,0 +1,177 @@
+package syncer
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/stretchr/testify/require"
+)
+
+// CommitTree commits a tree of the files to the remote without checking
+// their names, which git would refuse for some, and returns the new commit
+// hash. The worktree of the remote is left alone.
+func (r *testRemote) CommitTree(files map[string]string) string {
+	r.t.Helper()
+
+	head, err := r.repo.Head()
+	require.NoError(r.t, err)
+	signature := object.Signature{Name: "test", Email: "test@example.com", When: time.Now()}
+	hash := r.storeObject(&object.Commit{
+		Author:       signature,
+		Committer:    signature,
+		Message:      "update",
+		TreeHash:     r.storeTree(files),
+		ParentHashes: []plumbing.Hash{head.Hash()},
+	})
+	require.NoError(r.t, r.repo.Storer.SetReference(plumbing.NewHashReference(head.Name(), hash)))
+	return hash.String()
+}
+
+func (r *testRemote) storeTree(files map[string]string) plumbing.Hash {
+	tree := &object.Tree{}
+	dirs := map[string]map[string]string{}
+	for name, content := range files {
+		if dir, rest, ok := strings.Cut(name, "/"); ok {
+			if dirs[dir] == nil {
+				dirs[dir] = map[string]string{}
+			}
+			dirs[dir][rest] = content
+			continue
+		}
+		blob := r.repo.Storer.NewEncodedObject()
+		blob.SetType(plumbing.BlobObject)
+		w, err := blob.Writer()
+		require.NoError(r.t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(r.t, err)
+		require.NoError(r.t, w.Close())
+		hash, err := r.repo.Storer.SetEncodedObject(blob)
+		require.NoError(r.t, err)
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: name, Mode: filemode.Regular, Hash: hash})
+	}
+	for dir, sub := range dirs {
+		tree.Entries = append(tree.Entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: r.storeTree(sub)})
+	}
+
+	// git sorts directories as if their name ended with a slash.
+	key := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(tree.Entries, func(i, j int) bool { return key(tree.Entries[i]) < key(tree.Entries[j]) })
+	return r.storeObject(tree)
+}
+
+func (r *testRemote) storeObject(o interface {
+	Encode(plumbing.EncodedObject) error
+}) plumbing.Hash {
+	obj := r.repo.Storer.NewEncodedObject()
+	require.NoError(r.t, o.Encode(obj))
+	hash, err := r.repo.Storer.SetEncodedObject(obj)
+	require.NoError(r.t, err)
+	return hash
+}
+
+func TestPublish(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+
+	opts := remote.Options(filepath.Join(root, "current"))
+	opts.Publish = PublishOptions{Root: filepath.Join(root, "revs"), KeepRevisions: 2}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	first := s.Status().LatestHash
+	requirePublished(t, opts, first, "initial")
+
+	second := remote.Commit(map[string]string{"README.md": "second", "bin/run.sh": "#!/bin/sh"})
+	require.NoError(t, s.ForceSync())
+	requirePublished(t, opts, second, "second")
+	require.DirExists(t, filepath.Join(opts.Publish.Root, revisionPrefix+first))
+
+	third := remote.Commit(map[string]string{"README.md": "third"})
+	require.NoError(t, s.ForceSync())
+	requirePublished(t, opts, third, "third")
+	require.DirExists(t, filepath.Join(opts.Publish.Root, revisionPrefix+second))
+	require.NoDirExists(t, filepath.Join(opts.Publish.Root, revisionPrefix+first))
+}
+
+func requirePublished(t *testing.T, opts SyncOptions, hash string, readme string) {
+	t.Helper()
+
+	target, err := publishedRevision(opts.Path)
+	require.NoError(t, err)
+	require.Equal(t, revisionPrefix+hash, filepath.Base(target))
+	requireReadme(t, opts.Path, readme)
+}
+
+func TestPublishPrunesByPublishTime(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+
+	opts := remote.Options(filepath.Join(root, "current"))
+	opts.Publish = PublishOptions{Root: filepath.Join(root, "revs"), KeepRevisions: 2}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	first := s.Status().LatestHash
+	second := remote.Commit(map[string]string{"README.md": "second"})
+	require.NoError(t, s.ForceSync())
+
+	// The first revision is published again, so the second one is older.
+	require.NoError(t, s.Pin(first))
+	requirePublished(t, opts, first, "initial")
+	third := remote.Commit(map[string]string{"README.md": "third"})
+	require.NoError(t, s.Unpin())
+	requirePublished(t, opts, third, "third")
+	require.DirExists(t, filepath.Join(opts.Publish.Root, revisionPrefix+first))
+	require.NoDirExists(t, filepath.Join(opts.Publish.Root, revisionPrefix+second))
+}
+
+func TestPublishOptionsChange(t *testing.T) {
+	remote := newSparseRemote(t)
+	root := t.TempDir()
+	opts := remote.Options(filepath.Join(root, "current"))
+	opts.Publish = PublishOptions{Root: filepath.Join(root, "revs")}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	require.FileExists(t, filepath.Join(opts.Path, "deploy", "dev", "app.yaml"))
+
+	// The same commit is checked out again with the new sparse paths.
+	s.Options.Sparse = SparseOptions{Include: []string{"deploy/prod"}, Exclude: []string{"deploy/prod/secret"}}
+	require.NoError(t, s.ForceSync())
+	requireSparse(t, opts.Path)
+
+	s.Options.Sparse = SparseOptions{}
+	require.NoError(t, s.ForceSync())
+	require.FileExists(t, filepath.Join(opts.Path, "deploy", "dev", "app.yaml"))
+}
+
+func TestPublishUnsafePath(t *testing.T) {
+	for _, name := range []string{".git/hooks/post-checkout", "dir/.GIT/config", "../escape"} {
+		t.Run(name, func(t *testing.T) {
+			remote := newTestRemote(t)
+			root := t.TempDir()
+
+			opts := remote.Options(filepath.Join(root, "current"))
+			opts.Publish = PublishOptions{Root: filepath.Join(root, "revs")}
+			s := NewSyncer(opts)
+			require.NoError(t, s.ForceSync())
+			first := s.Status().LatestHash
+
+			remote.CommitTree(map[string]string{"README.md": "pwned", name: "pwned"})
+			require.ErrorIs(t, s.ForceSync(), ErrUnsafePath)
+			requirePublished(t, opts, first, "initial")
+			require.NoFileExists(t, filepath.Join(opts.Publish.Root, "escape"))
+		})
+	}
+}
@@ -0,0 +1,150 @@
+package syncer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+const (
+	// MarkerFile is written into the .git directory of every clone git-sync
+	// manages. Quarantine only moves directories that hold it.
+	MarkerFile = "git-sync.json"
+
+	// DefaultQuarantineKeep is the number of quarantined clones kept by
+	// default.
+	DefaultQuarantineKeep = 3
+
+	defaultQuarantineDir = ".git-sync-quarantine"
+	quarantineTimeFormat = "20060102T150405.000Z"
+)
+
+// ErrNotManaged is returned by Quarantine for a directory without MarkerFile.
+var ErrNotManaged = errors.New("directory is not managed by git-sync")
+
+type marker struct {
+	Repo    string    `json:"repo"`
+	Created time.Time `json:"created"`
+}
+
+func markerPath(repoPath string) string {
+	return filepath.Join(repoPath, git.GitDirName, MarkerFile)
+}
+
+// markManaged writes MarkerFile into a clone git-sync made. A clone made by an
+// earlier version is only marked when its origin is the tracked repo, so a
+// mistyped path never turns an unrelated repository into a managed one.
+func (s *Syncer) markManaged(repo *git.Repository, cloned bool) error {
+	path := markerPath(s.Options.repoPath())
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+
+	if !cloned {
+		remote, err := repo.Remote("origin")
+		if err != nil || len(remote.Config().URLs) == 0 || remote.Config().URLs[0] != s.Options.Auth.Repo {
+			return nil
+		}
+	}
+
+	data, err := json.Marshal(marker{Repo: s.Options.Auth.Repo, Created: time.Now()})
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// quarantineDir returns the directory broken clones are moved to. It defaults
+// to a directory next to the clone, so the move stays on the same file system.
+func (o SyncOptions) quarantineDir() string {
+	if o.QuarantineDir != "" {
+		return o.QuarantineDir
+	}
+	return filepath.Join(filepath.Dir(filepath.Clean(o.repoPath())), defaultQuarantineDir)
+}
+
+// Quarantine moves the local clone into the quarantine directory, so the next
+// sync clones the repo again, and returns where the clone was moved. It is
+// meant for clones that fail with ErrWorktreeCorrupt; other errors, like
+// ErrNetworkUnreachable, are not fixed by cloning again. A directory without
+// MarkerFile is left alone and ErrNotManaged is returned.
+func (s *Syncer) Quarantine() (string, error) {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	repoPath := s.Options.repoPath()
+	data, err := os.ReadFile(markerPath(repoPath))
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %w", ErrNotManaged, repoPath, err)
+	}
+	if err = json.Unmarshal(data, &marker{}); err != nil {
+		return "", fmt.Errorf("%w: %s: invalid marker: %w", ErrNotManaged, repoPath, err)
+	}
+
+	dir := s.Options.quarantineDir()
+	if err = os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+
+	name := filepath.Base(repoPath)
+	target := filepath.Join(dir, fmt.Sprintf("%s-%s", name, time.Now().UTC().Format(quarantineTimeFormat)))
+	if err = os.Rename(repoPath, target); err != nil {
+		return "", fmt.Errorf("moving %s to quarantine: %w", repoPath, err)
+	}
+	log.Printf("Moved %s to quarantine at %s", repoPath, target)
+
+	if err = pruneQuarantine(dir, name, s.Options.quarantineKeep()); err != nil {
+		log.Printf("Error removing old quarantined clones: %v", err)
+	}
+	return target, nil
+}
+
+func (o SyncOptions) quarantineKeep() int {
+	if o.QuarantineKeep == 0 {
+		return DefaultQuarantineKeep
+	}
+	return o.QuarantineKeep
+}
+
+// pruneQuarantine removes the oldest clones quarantined under name from dir so
+// that at most keep remain. A negative keep keeps all of them.
+func pruneQuarantine(dir string, name string, keep int) error {
+	if keep < 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// The quarantine directory may be shared with other clones, so only the
+	// entries named after this one are considered. Their timestamps sort in
+	// the order they were quarantined.
+	var copies []string
+	for _, entry := range entries {
+		stamp, ok := strings.CutPrefix(entry.Name(), name+"-")
+		if !ok {
+			continue
+		}
+		if _, err := time.Parse(quarantineTimeFormat, stamp); err == nil {
+			copies = append(copies, entry.Name())
+		}
+	}
+	sort.Strings(copies)
+
+	var errs []error
+	for _, old := range copies[:max(len(copies)-keep, 0)] {
+		log.Printf("Removing old quarantined clone %s", old)
+		errs = append(errs, os.RemoveAll(filepath.Join(dir, old)))
+	}
+	return errors.Join(errs...)
+}
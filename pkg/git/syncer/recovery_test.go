@@ -0,0 +1,84 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQuarantine(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+	path := filepath.Join(root, "repo")
+	s := NewSyncer(remote.Options(path))
+
+	require.NoError(t, s.ForceSync())
+	require.FileExists(t, filepath.Join(path, ".git", MarkerFile))
+
+	require.NoError(t, os.Remove(filepath.Join(path, ".git", "HEAD")))
+	require.ErrorIs(t, s.ForceSync(), ErrWorktreeCorrupt)
+
+	quarantined, err := s.Quarantine()
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(root, ".git-sync-quarantine"), filepath.Dir(quarantined))
+	require.FileExists(t, filepath.Join(quarantined, "README.md"), "the broken clone is kept")
+	require.NoDirExists(t, path)
+
+	require.NoError(t, s.ForceSync())
+	require.FileExists(t, filepath.Join(path, "README.md"))
+}
+
+func TestQuarantineKeep(t *testing.T) {
+	remote := newTestRemote(t)
+	root := t.TempDir()
+	opts := remote.Options(filepath.Join(root, "repo"))
+	opts.QuarantineKeep = 2
+	s := NewSyncer(opts)
+
+	// Clones of other repos sharing the directory are left alone.
+	dir := filepath.Join(root, ".git-sync-quarantine")
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "other-20060102T150405.000Z"), 0o700))
+
+	var quarantined []string
+	for range 3 {
+		require.NoError(t, s.ForceSync())
+		target, err := s.Quarantine()
+		require.NoError(t, err)
+		quarantined = append(quarantined, target)
+	}
+
+	require.NoDirExists(t, quarantined[0])
+	require.DirExists(t, quarantined[1])
+	require.DirExists(t, quarantined[2])
+	require.DirExists(t, filepath.Join(dir, "other-20060102T150405.000Z"))
+}
+
+func TestQuarantineUnmanaged(t *testing.T) {
+	remote := newTestRemote(t)
+	path := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(path, "important.txt"), []byte("keep"), 0o600))
+
+	s := NewSyncer(remote.Options(path))
+	_, err := s.Quarantine()
+	require.ErrorIs(t, err, ErrNotManaged)
+	require.FileExists(t, filepath.Join(path, "important.txt"))
+}
+
+func TestMarkExistingClone(t *testing.T) {
+	remote := newTestRemote(t)
+	path := filepath.Join(t.TempDir(), "repo")
+	_, err := git.PlainClone(path, false, &git.CloneOptions{URL: filepath.Join(remote.Path, ".git")})
+	require.NoError(t, err)
+
+	// A clone of another repo is not marked.
+	opts := remote.Options(path)
+	opts.Auth.Repo = filepath.Join(newTestRemote(t).Path, ".git")
+	_ = NewSyncer(opts).ForceSync()
+	require.NoFileExists(t, filepath.Join(path, ".git", MarkerFile))
+
+	require.NoError(t, NewSyncer(remote.Options(path)).ForceSync())
+	require.FileExists(t, filepath.Join(path, ".git", MarkerFile))
+}
@@ -0,0 +1,164 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	DefaultRetryInitialBackoff  = 5 * time.Second
+	DefaultRetryJitter          = 0.1
+	DefaultAuthFailureThreshold = 3
+	DefaultCircuitOpenDuration  = 30 * time.Minute
+)
+
+// RetryPolicy controls when polling syncs again after a sync. Transient
+// failures, i.e. network errors and timeouts, are retried sooner than the poll
+// interval with exponential backoff. Repeated authentication or host key
+// failures open a circuit that pauses polling, so a revoked credential does
+// not keep hitting the Git server.
+type RetryPolicy struct {
+	// InitialBackoff is the delay before the first retry of a transient
+	// failure, doubled after each failure. Defaults to
+	// DefaultRetryInitialBackoff.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the retry delay. Defaults to, and is never more than,
+	// the poll interval.
+	MaxBackoff time.Duration
+	// Jitter is the fraction of each delay that is randomly added or
+	// subtracted, so that replicas do not poll in lockstep. Defaults to
+	// DefaultRetryJitter, a negative value disables it.
+	Jitter float64
+	// AuthFailureThreshold is the number of authentication or host key
+	// failures in a row that open the circuit. Defaults to
+	// DefaultAuthFailureThreshold, a negative value disables the circuit.
+	AuthFailureThreshold int
+	// CircuitOpenDuration is how long polling pauses once the circuit is open.
+	// Defaults to DefaultCircuitOpenDuration.
+	CircuitOpenDuration time.Duration
+}
+
+func (p RetryPolicy) initialBackoff() time.Duration {
+	if p.InitialBackoff <= 0 {
+		return DefaultRetryInitialBackoff
+	}
+	return p.InitialBackoff
+}
+
+func (p RetryPolicy) maxBackoff(interval time.Duration) time.Duration {
+	if p.MaxBackoff <= 0 {
+		return interval
+	}
+	return min(p.MaxBackoff, interval)
+}
+
+func (p RetryPolicy) jitter() float64 {
+	switch {
+	case p.Jitter == 0:
+		return DefaultRetryJitter
+	case p.Jitter < 0:
+		return 0
+	default:
+		return min(p.Jitter, 1)
+	}
+}
+
+func (p RetryPolicy) authFailureThreshold() int {
+	if p.AuthFailureThreshold == 0 {
+		return DefaultAuthFailureThreshold
+	}
+	return p.AuthFailureThreshold
+}
+
+func (p RetryPolicy) circuitOpenDuration() time.Duration {
+	if p.CircuitOpenDuration <= 0 {
+		return DefaultCircuitOpenDuration
+	}
+	return p.CircuitOpenDuration
+}
+
+// withJitter randomly moves d by up to the jitter fraction in either
+// direction.
+func (p RetryPolicy) withJitter(d time.Duration) time.Duration {
+	j := p.jitter()
+	if j == 0 {
+		return d
+	}
+	//nolint:gosec // jitter does not need a secure random source
+	return time.Duration(float64(d) * (1 + j*(2*rand.Float64()-1)))
+}
+
+// isTransient reports whether a sync error is likely to go away on its own.
+func isTransient(err error) bool {
+	return errors.Is(err, ErrNetworkUnreachable) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// isCredentialError reports whether a sync error means the remote rejected
+// our credentials, or we rejected its host key.
+func isCredentialError(err error) bool {
+	return errors.Is(err, ErrAuthentication) || errors.Is(err, ErrHostKeyMismatch)
+}
+
+// updateCircuit counts the authentication and host key failures in a row and
+// opens the circuit once there are too many. Any other result closes it.
+func (s *Syncer) updateCircuit(err error) {
+	policy := s.Options.Retry
+
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	if !isCredentialError(err) {
+		if !s.circuitOpenUntil.IsZero() {
+			log.Printf("Closing circuit for Repo: %s", s.Options.Auth.Repo)
+		}
+		s.authFailures = 0
+		s.circuitOpenUntil = time.Time{}
+		return
+	}
+
+	s.authFailures++
+	threshold := policy.authFailureThreshold()
+	if threshold > 0 && s.authFailures >= threshold {
+		s.circuitOpenUntil = time.Now().Add(policy.circuitOpenDuration())
+		log.Printf("Opening circuit for Repo: %s after %d authentication failures, polling pauses until %s",
+			s.Options.Auth.Repo, s.authFailures, s.circuitOpenUntil.Format(time.RFC3339))
+	}
+}
+
+// circuitOpen reports whether polling is paused, and until when.
+func (s *Syncer) circuitOpen() (time.Time, bool) {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	return s.circuitOpenUntil, time.Now().Before(s.circuitOpenUntil)
+}
+
+// pollDelay returns the delay until the next poll after a sync that returned
+// err.
+func (s *Syncer) pollDelay(err error) time.Duration {
+	policy := s.Options.Retry
+	interval := s.Options.PollInterval
+
+	if until, open := s.circuitOpen(); open {
+		// Wake up at least every interval, as a successful webhook sync
+		// closes the circuit early.
+		return policy.withJitter(min(time.Until(until), interval))
+	}
+
+	if err == nil || !isTransient(err) {
+		return policy.withJitter(interval)
+	}
+
+	backoff := policy.initialBackoff()
+	maxBackoff := policy.maxBackoff(interval)
+	for range s.Status().ConsecutiveFailures - 1 {
+		if backoff >= maxBackoff {
+			break
+		}
+		backoff *= 2
+	}
+	return policy.withJitter(min(backoff, maxBackoff))
+}
@@ -0,0 +1,83 @@
+package syncer
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPollDelay(t *testing.T) {
+	s := NewSyncer(SyncOptions{
+		PollInterval: time.Minute,
+		Retry:        RetryPolicy{InitialBackoff: time.Second, Jitter: -1},
+	})
+	networkErr := classify(&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")})
+
+	require.Equal(t, time.Minute, s.pollDelay(nil))
+	require.Equal(t, time.Minute, s.pollDelay(ErrCommitNotFound), "permanent errors wait for the next poll")
+
+	for failures, want := range map[int]time.Duration{
+		1:  time.Second,
+		2:  2 * time.Second,
+		4:  8 * time.Second,
+		10: time.Minute,
+	} {
+		s.status.ConsecutiveFailures = failures
+		s.publish()
+		require.Equal(t, want, s.pollDelay(networkErr), "after %d failures", failures)
+	}
+
+	s.Options.Retry.MaxBackoff = 5 * time.Second
+	s.status.ConsecutiveFailures = 10
+	s.publish()
+	require.Equal(t, 5*time.Second, s.pollDelay(networkErr))
+}
+
+func TestJitter(t *testing.T) {
+	policy := RetryPolicy{Jitter: 0.5}
+	seen := map[time.Duration]bool{}
+	for range 100 {
+		d := policy.withJitter(time.Minute)
+		require.GreaterOrEqual(t, d, 30*time.Second)
+		require.LessOrEqual(t, d, 90*time.Second)
+		seen[d] = true
+	}
+	require.Greater(t, len(seen), 1)
+
+	require.Equal(t, time.Minute, RetryPolicy{Jitter: -1}.withJitter(time.Minute))
+}
+
+func TestCircuit(t *testing.T) {
+	s := NewSyncer(SyncOptions{
+		PollInterval: time.Minute,
+		Retry:        RetryPolicy{Jitter: -1, AuthFailureThreshold: 2, CircuitOpenDuration: time.Hour},
+	})
+	authErr := classify(transport.ErrAuthenticationRequired)
+
+	s.updateCircuit(authErr)
+	_, open := s.circuitOpen()
+	require.False(t, open)
+
+	s.updateCircuit(authErr)
+	until, open := s.circuitOpen()
+	require.True(t, open)
+	require.WithinDuration(t, time.Now().Add(time.Hour), until, time.Minute)
+	require.Equal(t, until, s.Status().CircuitOpenUntil)
+	require.Equal(t, time.Minute, s.pollDelay(authErr), "polling checks the circuit every interval")
+
+	s.updateCircuit(nil)
+	_, open = s.circuitOpen()
+	require.False(t, open)
+	require.True(t, s.Status().CircuitOpenUntil.IsZero())
+
+	s.Options.Retry.AuthFailureThreshold = -1
+	for range 5 {
+		s.updateCircuit(authErr)
+	}
+	_, open = s.circuitOpen()
+	require.False(t, open, "a negative threshold disables the circuit")
+}
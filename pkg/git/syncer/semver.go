@@ -0,0 +1,82 @@
+package syncer
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Masterminds/semver/v3"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// SemverRefPrefix marks a RefName that tracks the highest tag matching a
+// semver constraint, e.g. "semver:~1.4" or "semver:>=2.0.0 <3".
+const SemverRefPrefix = "semver:"
+
+var ErrNoMatchingTag = errors.New("no tag matches the semver constraint")
+
+// ParseSemverConstraint returns the constraint of a semver RefName, or nil if
+// ref does not use the semver mode.
+func ParseSemverConstraint(ref plumbing.ReferenceName) (*semver.Constraints, error) {
+	constraint, ok := strings.CutPrefix(string(ref), SemverRefPrefix)
+	if !ok {
+		return nil, nil
+	}
+
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid semver constraint %q: %w", constraint, err)
+	}
+	return c, nil
+}
+
+func isSemverRef(ref plumbing.ReferenceName) bool {
+	return strings.HasPrefix(string(ref), SemverRefPrefix)
+}
+
+// resolveSemverTag returns the highest tag that satisfies the constraint.
+// Pre-releases are skipped unless includePrerelease is set, in which case
+// they match when their release version does.
+func resolveSemverTag(repo *git.Repository, constraint *semver.Constraints, includePrerelease bool) (plumbing.ReferenceName, error) {
+	tags, err := repo.Tags()
+	if err != nil {
+		return "", err
+	}
+	defer tags.Close()
+
+	var best *semver.Version
+	var bestRef plumbing.ReferenceName
+	err = tags.ForEach(func(ref *plumbing.Reference) error {
+		v, err := semver.NewVersion(ref.Name().Short())
+		if err != nil {
+			return nil //nolint:nilerr // tags that are not versions are ignored
+		}
+
+		check := v
+		if v.Prerelease() != "" {
+			if !includePrerelease {
+				return nil
+			}
+			release, err := v.SetPrerelease("")
+			if err != nil {
+				return nil //nolint:nilerr // unreachable, clearing the prerelease is always valid
+			}
+			check = &release
+		}
+
+		if constraint.Check(check) && (best == nil || v.GreaterThan(best)) {
+			best = v
+			bestRef = ref.Name()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	if best == nil {
+		return "", ErrNoMatchingTag
+	}
+	return bestRef, nil
+}
@@ -0,0 +1,97 @@
+package syncer
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSemver(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.Tag("v1.4.0", "")
+	remote.Commit(map[string]string{"README.md": "1.4.2"})
+	remote.Tag("v1.4.2", "release 1.4.2")
+	remote.Commit(map[string]string{"README.md": "1.5.0-rc.1"})
+	remote.Tag("v1.5.0-rc.1", "")
+	remote.Commit(map[string]string{"README.md": "2.0.0"})
+	remote.Tag("v2.0.0", "")
+	remote.Tag("not-a-version", "")
+
+	tests := []struct {
+		ref               string
+		includePrerelease bool
+		resolved          string
+	}{
+		{ref: "semver:~1.4", resolved: "v1.4.2"},
+		{ref: "semver:>=1.4 <2", resolved: "v1.4.2"},
+		{ref: "semver:>=1.4 <2", includePrerelease: true, resolved: "v1.5.0-rc.1"},
+		{ref: "semver:>=2.0.0", resolved: "v2.0.0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ref, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "repo")
+			opts := remote.Options(path)
+			opts.RefName = plumbing.ReferenceName(tt.ref)
+			opts.IncludePrerelease = tt.includePrerelease
+			s := NewSyncer(opts)
+
+			require.NoError(t, s.ForceSync())
+			require.Equal(t, "refs/tags/"+tt.resolved, s.Status().ResolvedRef)
+			requireReadme(t, path, tt.resolved[1:])
+
+			// A second sync of an existing repo resolves the same tag.
+			require.NoError(t, s.ForceSync())
+			requireReadme(t, path, tt.resolved[1:])
+		})
+	}
+}
+
+func TestSemverNewRelease(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.Tag("v1.0.0", "")
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.RefName = "semver:^1"
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireReadme(t, path, "initial")
+
+	hash := remote.Commit(map[string]string{"README.md": "1.1.0"})
+	remote.Tag("v1.1.0", "release 1.1.0")
+	require.NoError(t, s.ForceSync())
+	requireReadme(t, path, "1.1.0")
+	require.Equal(t, hash, s.Status().LatestHash)
+}
+
+func TestSemverNoMatch(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.Tag("v1.0.0", "")
+
+	opts := remote.Options(filepath.Join(t.TempDir(), "repo"))
+	opts.RefName = "semver:>=3"
+	require.ErrorIs(t, NewSyncer(opts).ForceSync(), ErrNoMatchingTag)
+
+	_, err := ParseSemverConstraint("semver:not a constraint")
+	require.Error(t, err)
+}
+
+func TestTagRef(t *testing.T) {
+	remote := newTestRemote(t)
+	remote.Tag("v1.0.0", "release 1.0.0")
+	remote.Commit(map[string]string{"README.md": "changed"})
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.RefName = "refs/tags/v1.0.0"
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireReadme(t, path, "initial")
+	require.NoError(t, s.ForceSync())
+	requireReadme(t, path, "initial")
+}
@@ -0,0 +1,91 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+const (
+	// unshallowDepth is the depth git fetch --unshallow asks for, which
+	// fetches the complete history.
+	unshallowDepth = math.MaxInt32
+	// deepenSteps is how often a sync doubles the depth before it fetches
+	// the complete history.
+	deepenSteps = 3
+)
+
+// deepen fetches more history while the shallow clone misses the history the
+// sync to target needs, see missingHistory. The depth is doubled up to
+// deepenSteps times, and then the complete history is fetched.
+func (s *Syncer) deepen(ctx context.Context, repo *git.Repository, remote plumbing.Hash, target plumbing.Hash) error {
+	depth := s.Options.Depth
+	for step := 0; depth != unshallowDepth && missingHistory(repo, remote, target); step++ {
+		depth *= 2
+		if step == deepenSteps || depth >= unshallowDepth/2 {
+			depth = unshallowDepth
+		}
+		log.Printf("The shallow history does not reach %s, deepening to %d commits", target, depth)
+
+		if err := s.acquireSlot(ctx, PhaseFetching); err != nil {
+			return err
+		}
+		start := time.Now()
+		fetchCtx, cancel := phaseContext(ctx, s.Options.Timeouts.Fetch)
+		err := fetchRepo(fetchCtx, repo, s.Options, depth, &s.status.Fetch)
+		err = phaseError(fetchCtx, OperationFetch, s.Options.Timeouts.Fetch, err)
+		cancel()
+		release(s.limiter)
+		s.observe(OperationFetch, start)
+		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return fmt.Errorf("fetch failed: %w", err)
+		}
+	}
+	return nil
+}
+
+// missingHistory reports whether a shallow fetch left out history the sync to
+// target needs: the target commit itself, or the commits between the remote
+// commit and a pinned target, which tell how far behind the pin is.
+func missingHistory(repo *git.Repository, remote plumbing.Hash, target plumbing.Hash) bool {
+	if _, err := repo.CommitObject(target); err != nil {
+		return true
+	}
+	if remote == target {
+		return false
+	}
+
+	iter, err := repo.Log(&git.LogOptions{From: remote})
+	if err != nil {
+		return false
+	}
+	defer iter.Close()
+
+	// A pin that is not in the history of the remote commit is found at
+	// none of the commits, which is only missing history if a parent is.
+	err = iter.ForEach(func(c *object.Commit) error {
+		if c.Hash == target {
+			return storer.ErrStop
+		}
+		return nil
+	})
+	return errors.Is(err, plumbing.ErrObjectNotFound)
+}
+
+// shallowFetchFailed reports whether a shallow fetch failed in a way that
+// fetching the complete history may fix.
+func shallowFetchFailed(ctx context.Context, err error) bool {
+	if err == nil || errors.Is(err, git.NoErrAlreadyUpToDate) || ctx.Err() != nil {
+		return false
+	}
+	err = classify(err)
+	return !isTransient(err) && !isCredentialError(err)
+}
@@ -0,0 +1,119 @@
+package syncer
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/file"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/stretchr/testify/require"
+)
+
+// useGitBinary serves file:// remotes with git-upload-pack for the test, as
+// the in-process server does not support shallow fetches.
+func useGitBinary(t *testing.T) {
+	t.Helper()
+
+	if _, err := exec.LookPath("git-upload-pack"); err != nil {
+		t.Skip("git-upload-pack is not installed")
+	}
+	client.InstallProtocol("file", file.DefaultClient)
+	t.Cleanup(func() {
+		client.InstallProtocol("file", server.NewClient(server.DefaultLoader))
+	})
+}
+
+// commitCount counts the commits of the clone at path from HEAD back to the
+// first missing parent.
+func commitCount(t *testing.T, path string) int {
+	t.Helper()
+
+	repo, err := git.PlainOpen(path)
+	require.NoError(t, err)
+	head, err := repo.Head()
+	require.NoError(t, err)
+
+	count := 0
+	hash := head.Hash()
+	for {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return count
+		}
+		count++
+		if commit.NumParents() == 0 {
+			return count
+		}
+		hash = commit.ParentHashes[0]
+	}
+}
+
+func TestDepth(t *testing.T) {
+	useGitBinary(t)
+	remote := newTestRemote(t)
+	for i := range 4 {
+		remote.Commit(map[string]string{"README.md": string(rune('a' + i))})
+	}
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.Depth = 1
+	s := NewSyncer(opts)
+	require.NoError(t, s.ForceSync())
+	require.Equal(t, 1, commitCount(t, path))
+
+	// More new commits than the depth are checked out without the history
+	// between them.
+	var hash string
+	for i := range 5 {
+		hash = remote.Commit(map[string]string{"README.md": string(rune('v' + i))})
+	}
+	require.NoError(t, s.ForceSync())
+	require.Equal(t, hash, s.Status().LatestHash)
+	content, err := os.ReadFile(filepath.Join(path, "README.md"))
+	require.NoError(t, err)
+	require.Equal(t, "z", string(content))
+	require.Equal(t, 1, commitCount(t, path))
+
+	// Switching to another branch keeps the clone shallow.
+	w, err := remote.repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("other"), Create: true}))
+	hash = remote.Commit(map[string]string{"other.txt": "other"})
+
+	s.Options.RefName = plumbing.NewBranchReferenceName("other")
+	require.NoError(t, s.ForceSync())
+	require.Equal(t, hash, s.Status().LatestHash)
+	require.FileExists(t, filepath.Join(path, "other.txt"))
+}
+
+func TestDepthPin(t *testing.T) {
+	useGitBinary(t)
+	remote := newTestRemote(t)
+	var hashes []string
+	for i := range 10 {
+		hashes = append(hashes, remote.Commit(map[string]string{"README.md": string(rune('a' + i))}))
+	}
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.Depth = 1
+	s := NewSyncer(opts)
+	require.NoError(t, s.ForceSync())
+	require.Equal(t, 1, commitCount(t, path))
+
+	// A pin outside the shallow history deepens it until it reaches the pin.
+	require.NoError(t, s.Pin(hashes[6]))
+	requireReadme(t, path, "g")
+	require.Equal(t, 3, s.Status().CommitsBehind)
+
+	// Finally the complete history is fetched.
+	require.NoError(t, s.Pin(hashes[0]))
+	requireReadme(t, path, "a")
+	require.Equal(t, 9, s.Status().CommitsBehind)
+}
@@ -0,0 +1,45 @@
+package syncer
+
+import (
+	"path"
+	"strings"
+)
+
+// SparseOptions limit the worktree to some paths of the repository. The paths
+// are directories or files relative to the repository root with cone
+// semantics: a directory stands for everything below it.
+type SparseOptions struct {
+	// Include are the paths checked out. Empty means every path.
+	Include []string
+	// Exclude are the paths left out, also when they are below an included
+	// one.
+	Exclude []string
+}
+
+// Enabled reports whether only some paths are checked out.
+func (o SparseOptions) Enabled() bool {
+	return len(o.Include) > 0 || len(o.Exclude) > 0
+}
+
+// match reports whether the file is checked out.
+func (o SparseOptions) match(name string) bool {
+	return (len(o.Include) == 0 || underAny(name, o.Include)) && !underAny(name, o.Exclude)
+}
+
+func cleanSparsePath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// under reports whether name is dir or below it. The empty dir is the root.
+func under(name string, dir string) bool {
+	return dir == "" || name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+func underAny(name string, dirs []string) bool {
+	for _, dir := range dirs {
+		if under(name, cleanSparsePath(dir)) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/stretchr/testify/require"
+)
+
+func newSparseRemote(t *testing.T) *testRemote {
+	t.Helper()
+
+	remote := newTestRemote(t)
+	remote.Commit(map[string]string{
+		"deploy/prod/app.yaml":   "prod",
+		"deploy/prod/secret/key": "secret",
+		"deploy/production.txt":  "not prod",
+		"deploy/dev/app.yaml":    "dev",
+	})
+	return remote
+}
+
+func requireSparse(t *testing.T, dir string) {
+	t.Helper()
+
+	content, err := os.ReadFile(filepath.Join(dir, "deploy", "prod", "app.yaml"))
+	require.NoError(t, err)
+	require.Equal(t, "prod", string(content))
+	require.NoFileExists(t, filepath.Join(dir, "deploy", "prod", "secret", "key"))
+	require.NoFileExists(t, filepath.Join(dir, "deploy", "production.txt"))
+	require.NoFileExists(t, filepath.Join(dir, "deploy", "dev", "app.yaml"))
+	require.NoFileExists(t, filepath.Join(dir, "README.md"))
+}
+
+func TestSparse(t *testing.T) {
+	remote := newSparseRemote(t)
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.Sparse = SparseOptions{Include: []string{"deploy/prod/"}, Exclude: []string{"deploy/prod/secret"}}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireSparse(t, path)
+
+	// Updates and syncs without a change keep the worktree sparse.
+	remote.Commit(map[string]string{"deploy/dev/app.yaml": "dev 2", "deploy/prod/secret/key": "secret 2"})
+	require.NoError(t, s.ForceSync())
+	requireSparse(t, path)
+
+	// Local changes to included files are reset.
+	require.NoError(t, os.WriteFile(filepath.Join(path, "deploy", "prod", "app.yaml"), []byte("drift"), 0o600))
+	require.NoError(t, s.ForceSync())
+	requireSparse(t, path)
+
+	// So does a switch to another branch.
+	w, err := remote.repo.Worktree()
+	require.NoError(t, err)
+	require.NoError(t, w.Checkout(&git.CheckoutOptions{Branch: plumbing.NewBranchReferenceName("other"), Create: true}))
+	hash := remote.Commit(map[string]string{"deploy/dev/other.yaml": "other"})
+
+	s.Options.RefName = plumbing.NewBranchReferenceName("other")
+	require.NoError(t, s.ForceSync())
+	require.Equal(t, hash, s.Status().LatestHash)
+	requireSparse(t, path)
+	require.NoFileExists(t, filepath.Join(path, "deploy", "dev", "other.yaml"))
+
+	// Without sparse options the whole worktree is checked out again.
+	s.Options.Sparse = SparseOptions{}
+	require.NoError(t, s.ForceSync())
+	require.FileExists(t, filepath.Join(path, "deploy", "dev", "other.yaml"))
+	require.FileExists(t, filepath.Join(path, "deploy", "prod", "secret", "key"))
+}
+
+func TestSparsePublish(t *testing.T) {
+	remote := newSparseRemote(t)
+	root := t.TempDir()
+	opts := remote.Options(filepath.Join(root, "current"))
+	opts.Publish = PublishOptions{Root: filepath.Join(root, "revs")}
+	opts.Sparse = SparseOptions{Include: []string{"deploy/prod"}, Exclude: []string{"deploy/prod/secret/"}}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireSparse(t, opts.Path)
+}
@@ -0,0 +1,119 @@
+package syncer
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+)
+
+// StateFile is written into the .git directory of the clone, unless
+// SyncOptions.StateFile is set, so the status survives a restart.
+const StateFile = "git-sync-state.json"
+
+const stateVersion = 1
+
+// state is the content of the state file.
+type state struct {
+	Version int        `json:"version"`
+	Repo    string     `json:"repo"`
+	Status  SyncStatus `json:"status"`
+	// History is only saved when HistoryOptions.Persist is set.
+	History []HistoryEntry `json:"history,omitempty"`
+}
+
+func (o SyncOptions) stateFile() string {
+	if o.StateFile != "" {
+		return o.StateFile
+	}
+	return filepath.Join(o.repoPath(), git.GitDirName, StateFile)
+}
+
+// restoreState loads the status saved by an earlier run. A missing or invalid
+// state file, or one saved for another repo, is ignored. The restored status
+// is checked against the worktree by the first sync.
+func (s *Syncer) restoreState() {
+	path := s.Options.stateFile()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Error reading state file %s: %v", path, err)
+		}
+		return
+	}
+
+	var saved state
+	if err = json.Unmarshal(data, &saved); err != nil || saved.Version != stateVersion {
+		log.Printf("Ignoring invalid state file %s", path)
+		return
+	}
+	if saved.Repo != s.Options.Auth.Repo {
+		log.Printf("Ignoring state file %s of Repo: %s", path, saved.Repo)
+		return
+	}
+
+	// Only the outcome of earlier syncs is restored, not what was running.
+	status := saved.Status
+	status.Phase = PhaseIdle
+	status.InProgress = false
+	status.SyncStarted = time.Time{}
+	status.NextPoll = time.Time{}
+	status.CircuitOpenUntil = time.Time{}
+	status.Degraded = false
+
+	s.deliveries = status.Notifications
+	status.Notifications = nil
+	s.status = status
+	s.restoredHash = status.LatestHash
+	s.publish()
+
+	if s.Options.History.Persist {
+		s.history = appendHistory(nil, s.Options.History.limit(), saved.History...)
+	}
+}
+
+// saveState writes the status to the state file, replacing it atomically. It
+// must be called with syncLock held. Errors are only logged.
+func (s *Syncer) saveState() {
+	path := s.Options.stateFile()
+
+	status := s.status
+	s.deliveriesLock.Lock()
+	status.Notifications = slices.Clone(s.deliveries)
+	s.deliveriesLock.Unlock()
+
+	saved := state{Version: stateVersion, Repo: s.Options.Auth.Repo, Status: status}
+	if s.Options.History.Persist {
+		saved.History = s.History()
+	}
+
+	data, err := json.Marshal(saved)
+	if err == nil && s.Options.StateFile != "" {
+		err = os.MkdirAll(filepath.Dir(path), 0o700)
+	}
+	if err == nil {
+		err = writeFileAtomic(path, data)
+	}
+
+	// Without a clone there is no .git directory to save the default state
+	// file to, and no state worth saving.
+	if err != nil && (s.Options.StateFile != "" || !errors.Is(err, fs.ErrNotExist)) {
+		log.Printf("Error saving state file %s: %v", path, err)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// over path, so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
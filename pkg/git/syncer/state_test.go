@@ -0,0 +1,79 @@
+package syncer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreState(t *testing.T) {
+	remote := newTestRemote(t)
+	path := filepath.Join(t.TempDir(), "repo")
+	s := NewSyncer(remote.Options(path))
+
+	require.NoError(t, s.ForceSync())
+	first := s.Status().LatestHash
+	remote.Commit(map[string]string{"README.md": "changed"})
+	require.NoError(t, s.ForceSync())
+	require.NoError(t, s.PinPrevious())
+	saved := s.Status()
+	require.FileExists(t, filepath.Join(path, ".git", StateFile))
+
+	s = NewSyncer(remote.Options(path))
+	status := s.Status()
+	require.Equal(t, first, status.LatestHash)
+	require.Equal(t, first, status.PinnedHash)
+	require.Equal(t, saved.PreviousHash, status.PreviousHash)
+	require.True(t, saved.LastUpdated.Equal(status.LastUpdated))
+	require.Equal(t, PhaseIdle, status.Phase)
+
+	// The commit did not change, so neither does LastUpdated.
+	require.NoError(t, s.ForceSync())
+	require.True(t, saved.LastUpdated.Equal(s.Status().LastUpdated))
+
+	// The state of another repo is ignored.
+	opts := remote.Options(path)
+	opts.Auth.Repo = remote.Path
+	require.Empty(t, NewSyncer(opts).Status().LatestHash)
+}
+
+func TestRestoreStateUnpinned(t *testing.T) {
+	remote := newTestRemote(t)
+	path := filepath.Join(t.TempDir(), "repo")
+	s := NewSyncer(remote.Options(path))
+	require.NoError(t, s.ForceSync())
+	saved := s.Status()
+
+	// The forced sync after a restart checks out the same commit, which is
+	// not an update.
+	s = NewSyncer(remote.Options(path))
+	require.NoError(t, s.ForceSync())
+	status := s.Status()
+	require.Equal(t, saved.LatestHash, status.LatestHash)
+	require.True(t, saved.LastUpdated.Equal(status.LastUpdated))
+
+	remote.Commit(map[string]string{"README.md": "changed"})
+	require.NoError(t, s.ForceSync())
+	require.True(t, s.Status().LastUpdated.After(saved.LastUpdated))
+}
+
+func TestRestoreStateWorktreeChanged(t *testing.T) {
+	remote := newTestRemote(t)
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.StateFile = filepath.Join(t.TempDir(), "state", "repo.json")
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	require.FileExists(t, opts.StateFile)
+
+	// A worktree removed since the state was saved is cloned again.
+	require.NoError(t, os.RemoveAll(path))
+	s = NewSyncer(opts)
+	require.NotEmpty(t, s.Status().LatestHash)
+	require.NoError(t, s.ForceSync())
+	require.FileExists(t, filepath.Join(path, "README.md"))
+	require.Equal(t, HealthOK, s.Status().Health())
+}
@@ -0,0 +1,135 @@
+package syncer
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// The phases of a sync reported in SyncStatus.Phase.
+const (
+	PhaseIdle         = "idle"
+	PhaseWaiting      = "waiting"
+	PhaseCloning      = "cloning"
+	PhaseFetching     = "fetching"
+	PhaseCheckingOut  = "checking_out"
+	PhaseRunningHooks = "running_hooks"
+)
+
+// The health of a Syncer reported by SyncStatus.Health.
+const (
+	HealthOK = "ok"
+	// HealthDegraded means the last sync failed, but the worktree of an
+	// earlier sync is served.
+	HealthDegraded = "degraded"
+	// HealthUnavailable means there is no worktree yet.
+	HealthUnavailable = "unavailable"
+)
+
+// Health summarizes whether the worktree is available and current.
+func (s SyncStatus) Health() string {
+	switch {
+	case s.LatestHash == "":
+		return HealthUnavailable
+	case s.Degraded:
+		return HealthDegraded
+	default:
+		return HealthOK
+	}
+}
+
+// CommitInfo describes a commit.
+type CommitInfo struct {
+	Hash      string    `json:"hash"`
+	Author    string    `json:"author"`
+	Committer string    `json:"committer"`
+	Message   string    `json:"message"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// recordResult updates the status for a finished sync that started at start.
+func (s *Syncer) recordResult(start time.Time, err error) {
+	s.status.LastSyncDuration = time.Since(start)
+	s.status.Degraded = err != nil && s.status.LatestHash != ""
+
+	if err != nil {
+		s.status.LastError = err.Error()
+		s.status.LastErrorTime = time.Now()
+		s.status.ConsecutiveFailures++
+		return
+	}
+
+	s.status.LastSuccess = time.Now()
+	s.status.ConsecutiveFailures = 0
+}
+
+// updateCommitInfo describes LatestHash in the status, looking the commit up
+// only when it changed.
+func (s *Syncer) updateCommitInfo(repo *git.Repository) {
+	if s.status.LatestHash == "" || s.status.Commit != nil && s.status.Commit.Hash == s.status.LatestHash {
+		return
+	}
+
+	commit, err := repo.CommitObject(plumbing.NewHash(s.status.LatestHash))
+	if err != nil {
+		s.status.Commit = nil
+		return
+	}
+
+	s.status.Commit = &CommitInfo{
+		Hash:      commit.Hash.String(),
+		Author:    fmt.Sprintf("%s <%s>", commit.Author.Name, commit.Author.Email),
+		Committer: fmt.Sprintf("%s <%s>", commit.Committer.Name, commit.Committer.Email),
+		Message:   commit.Message,
+		Timestamp: commit.Committer.When,
+	}
+}
+
+// setNextPoll records when the next poll is due.
+func (s *Syncer) setNextPoll(next time.Time) {
+	s.statusLock.Lock()
+	s.nextPoll = next
+	s.statusLock.Unlock()
+}
+
+// syncCall is a sync that callers of syncRepo wait for.
+type syncCall struct {
+	done chan struct{}
+	err  error
+	// ctx is canceled by Cancel, or when no caller waits for the sync
+	// anymore.
+	ctx       context.Context
+	cancel    context.CancelFunc
+	canceled  bool
+	forcePull bool
+	started   time.Time
+	// joined counts the callers that share the sync with the one that
+	// started it, waiters the callers still waiting for it.
+	joined  int
+	waiters int
+	// fetching is set once the sync got a slot and began talking to the
+	// remote. Later callers no longer join it.
+	fetching bool
+}
+
+// setPhase moves the sync to the phase and publishes the status. It must be
+// called with syncLock held.
+func (s *Syncer) setPhase(phase string) {
+	s.status.Phase = phase
+	s.publish()
+}
+
+// publish makes the status visible to Status. It must be called with syncLock
+// held.
+func (s *Syncer) publish() {
+	status := s.status
+	status.Hooks = slices.Clone(status.Hooks)
+
+	s.statusLock.Lock()
+	s.published = status
+	s.statusLock.Unlock()
+}
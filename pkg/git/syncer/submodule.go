@@ -0,0 +1,382 @@
+package syncer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// DefaultSubmoduleMaxDepth is how deep submodules are nested by default.
+const DefaultSubmoduleMaxDepth = 10
+
+// ErrSubmoduleNotAllowed is returned when the URL of a submodule does not
+// match SubmoduleOptions.AllowedURLs.
+var ErrSubmoduleNotAllowed = errors.New("submodule URL not allowed")
+
+// SubmoduleOptions configures the checkout of the submodules of the synced
+// commit. They are fetched into the .git/modules directory of the repository,
+// like git does, and checked out after the repository.
+type SubmoduleOptions struct {
+	Enabled bool
+	// MaxDepth limits the nesting of submodules. 1 checks out the submodules
+	// of the repository but not theirs. Defaults to DefaultSubmoduleMaxDepth.
+	MaxDepth int
+	// AllowedURLs are path.Match patterns, e.g. https://github.com/org/*,
+	// that the resolved submodule URLs must match. Empty allows every URL.
+	AllowedURLs []string
+	// Auth overrides the credentials of SyncOptions.Auth for the submodule
+	// at the path, relative to the root of the repository. Repo is ignored.
+	Auth map[string]AuthOptions
+}
+
+func (o SubmoduleOptions) maxDepth() int {
+	if o.MaxDepth <= 0 {
+		return DefaultSubmoduleMaxDepth
+	}
+	return o.MaxDepth
+}
+
+func (o SubmoduleOptions) allowed(url string) bool {
+	if len(o.AllowedURLs) == 0 {
+		return true
+	}
+	return slices.ContainsFunc(o.AllowedURLs, func(pattern string) bool {
+		ok, _ := path.Match(pattern, url)
+		return ok
+	})
+}
+
+// SubmoduleStatus is a submodule checked out by the last sync.
+type SubmoduleStatus struct {
+	// Path is relative to the root of the repository, also for nested
+	// submodules.
+	Path   string `json:"path"`
+	URL    string `json:"url"`
+	Commit string `json:"commit"`
+}
+
+// submodule is a submodule of a commit.
+type submodule struct {
+	name string
+	path string
+	url  string
+	hash plumbing.Hash
+}
+
+// updateSubmodules checks out the submodules of the commit below dir. dir is
+// the worktree of repo when inPlace is set, or else a published revision.
+func (s *Syncer) updateSubmodules(ctx context.Context, repo *git.Repository, hash plumbing.Hash, dir string, inPlace bool) error {
+	if !s.Options.Submodules.Enabled {
+		s.status.Submodules = nil
+		return nil
+	}
+
+	statuses, err := s.checkoutSubmodules(ctx, repo, hash, s.Options.Auth.Repo, dir, "", 1, inPlace)
+	if err != nil {
+		return err
+	}
+
+	previous := make(map[string]string, len(s.status.Submodules))
+	for _, sub := range s.status.Submodules {
+		previous[sub.Path] = sub.Commit
+	}
+	for _, sub := range statuses {
+		if previous[sub.Path] != sub.Commit {
+			log.Printf("Submodule %s updated to %s", sub.Path, sub.Commit)
+		}
+	}
+	s.status.Submodules = statuses
+	return nil
+}
+
+// checkoutSubmodules checks out the submodules of the commit of repo, whose
+// URL is url, below dir and recurses into them. prefix is the path of dir
+// relative to the root of the repository.
+func (s *Syncer) checkoutSubmodules(ctx context.Context, repo *git.Repository, hash plumbing.Hash, url string, dir string, prefix string, depth int, inPlace bool) ([]SubmoduleStatus, error) {
+	subs, err := listSubmodules(repo, hash, url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list submodules: %w", err)
+	}
+
+	var statuses []SubmoduleStatus
+	for _, sub := range subs {
+		name := path.Join(prefix, sub.path)
+		if !s.Options.Sparse.match(name) {
+			continue
+		}
+		if !s.Options.Submodules.allowed(sub.url) {
+			return nil, fmt.Errorf("%w: submodule %s: %s", ErrSubmoduleNotAllowed, name, sub.url)
+		}
+
+		target := filepath.Join(dir, filepath.FromSlash(sub.path))
+		subRepo, err := s.fetchSubmodule(ctx, repo, sub, name, target, inPlace)
+		if err != nil {
+			return nil, fmt.Errorf("submodule %s: %w", name, err)
+		}
+		if err = checkoutSubmodule(ctx, subRepo, sub.hash, target, inPlace); err != nil {
+			return nil, fmt.Errorf("submodule %s: checkout failed: %w", name, err)
+		}
+		statuses = append(statuses, SubmoduleStatus{Path: name, URL: sub.url, Commit: sub.hash.String()})
+
+		if depth < s.Options.Submodules.maxDepth() {
+			nested, err := s.checkoutSubmodules(ctx, subRepo, sub.hash, sub.url, target, name, depth+1, inPlace)
+			if err != nil {
+				return nil, err
+			}
+			statuses = append(statuses, nested...)
+		}
+	}
+	return statuses, nil
+}
+
+// listSubmodules returns the submodules of the commit in the order of their
+// paths, with their URLs resolved against url.
+func listSubmodules(repo *git.Repository, hash plumbing.Hash, url string) ([]submodule, error) {
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCommitNotFound, hash, err)
+	}
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := tree.File(".gitmodules")
+	if errors.Is(err, object.ErrFileNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	content, err := file.Contents()
+	if err != nil {
+		return nil, err
+	}
+	modules := config.NewModules()
+	if err = modules.Unmarshal([]byte(content)); err != nil {
+		return nil, fmt.Errorf("invalid .gitmodules: %w", err)
+	}
+
+	var subs []submodule
+	for _, name := range slices.Sorted(maps.Keys(modules.Submodules)) {
+		m := modules.Submodules[name]
+		if err = m.Validate(); err != nil {
+			return nil, fmt.Errorf("submodule %s: %w", name, err)
+		}
+		// The name is a directory below .git/modules.
+		if !filepath.IsLocal(m.Name) || checkPath(m.Path) != nil {
+			return nil, fmt.Errorf("%w: submodule %s", ErrUnsafePath, name)
+		}
+
+		// Like git, skip modules that are not in the commit.
+		entry, err := tree.FindEntry(m.Path)
+		if err != nil || entry.Mode != filemode.Submodule {
+			continue
+		}
+		subs = append(subs, submodule{
+			name: m.Name,
+			path: path.Clean(m.Path),
+			url:  resolveSubmoduleURL(url, m.URL),
+			hash: entry.Hash,
+		})
+	}
+
+	slices.SortFunc(subs, func(a, b submodule) int {
+		return strings.Compare(a.path, b.path)
+	})
+	return subs, nil
+}
+
+// resolveSubmoduleURL resolves a submodule URL starting with ./ or ../
+// against the URL of the repository it belongs to, like git does.
+func resolveSubmoduleURL(parent string, url string) string {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url
+	}
+
+	// Keep the scheme and host of scheme://host/path and host:path URLs.
+	base, rest := "", parent
+	if i := strings.Index(parent, "://"); i >= 0 {
+		if j := strings.Index(parent[i+3:], "/"); j >= 0 {
+			base, rest = parent[:i+3+j], parent[i+3+j:]
+		} else {
+			base, rest = parent, "/"
+		}
+	} else if i := strings.Index(parent, ":"); i > 0 && !strings.Contains(parent[:i], "/") {
+		base, rest = parent[:i+1], parent[i+1:]
+	}
+	return base + path.Join(rest, url)
+}
+
+// fetchSubmodule opens the repository of the submodule, with its worktree at
+// dir when inPlace is set, and fetches the commit unless it has it already.
+func (s *Syncer) fetchSubmodule(ctx context.Context, parent *git.Repository, sub submodule, name string, dir string, inPlace bool) (*git.Repository, error) {
+	if inPlace {
+		// Registered like git submodule init does, so that go-git updates the
+		// submodule in the index of the parent on a reset.
+		if err := initSubmodule(parent, sub); err != nil {
+			return nil, err
+		}
+	}
+
+	repo, err := openSubmodule(parent, sub.name, dir, inPlace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repo: %w", err)
+	}
+	if _, err = repo.CommitObject(sub.hash); err == nil {
+		return repo, nil
+	}
+
+	if err = setOrigin(repo, sub.url); err != nil {
+		return nil, err
+	}
+
+	authOpts := s.Options.Auth
+	if override, ok := s.Options.Submodules.Auth[name]; ok {
+		authOpts = override
+	}
+	authOpts.Repo = sub.url
+	auth, err := createAuthFromOpts(authOpts)
+	if err != nil {
+		return nil, err
+	}
+	caBundle, err := getCABundleFromFile(s.Options.CABuntleFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like the fetch of the repository, each fetch waits for a sync slot and
+	// is limited by the fetch timeout.
+	fetch := func(opts *git.FetchOptions) error {
+		return s.download(ctx, OperationFetch, func(ctx context.Context) error {
+			return repo.FetchContext(ctx, opts)
+		})
+	}
+
+	log.Printf("Fetching submodule %s from %s", name, sub.url)
+	opts := &git.FetchOptions{
+		RemoteName:      "origin",
+		Depth:           s.Options.Depth,
+		Auth:            auth,
+		Force:           true,
+		InsecureSkipTLS: authOpts.InsecureSkipTLS,
+		Tags:            git.AllTags,
+		CABundle:        caBundle,
+		RefSpecs:        []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+	}
+	err = fetch(opts)
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+		return nil, fmt.Errorf("fetch failed: %w", err)
+	}
+	if _, err = repo.CommitObject(sub.hash); err == nil {
+		return repo, nil
+	}
+
+	// The commit is on no branch or tag any more, or further from them than
+	// the depth, ask for it by hash.
+	byHash := *opts
+	byHash.Tags = git.NoTags
+	byHash.RefSpecs = []config.RefSpec{config.RefSpec("+" + sub.hash.String() + ":" + sub.hash.String())}
+	err = fetch(&byHash)
+	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) && !errors.Is(err, git.ErrExactSHA1NotSupported) {
+		return nil, fmt.Errorf("fetch failed: %w", err)
+	}
+	_, err = repo.CommitObject(sub.hash)
+	if err != nil && opts.Depth > 0 {
+		// The server cannot send the commit by hash, so fall back to the
+		// complete history like switchReference does.
+		log.Printf("Shallow fetch of submodule %s did not include %s, fetching the complete history", name, sub.hash)
+		opts.Depth = unshallowDepth
+		err = fetch(opts)
+		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
+			return nil, fmt.Errorf("fetch failed: %w", err)
+		}
+		_, err = repo.CommitObject(sub.hash)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrCommitNotFound, sub.hash, err)
+	}
+	return repo, nil
+}
+
+// initSubmodule registers the submodule in the config of the parent.
+func initSubmodule(parent *git.Repository, sub submodule) error {
+	cfg, err := parent.Config()
+	if err != nil {
+		return err
+	}
+	if m, ok := cfg.Submodules[sub.name]; ok && m.Path == sub.path && m.URL == sub.url {
+		return nil
+	}
+
+	cfg.Submodules[sub.name] = &config.Submodule{Name: sub.name, Path: sub.path, URL: sub.url}
+	return parent.SetConfig(cfg)
+}
+
+// openSubmodule opens the repository of the submodule in the modules
+// directory of the parent, initializing it on first use.
+func openSubmodule(parent *git.Repository, name string, dir string, inPlace bool) (*git.Repository, error) {
+	storer, err := parent.Storer.Module(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var worktree billy.Filesystem
+	if inPlace {
+		worktree = osfs.New(dir)
+	}
+	repo, err := git.Open(storer, worktree)
+	if errors.Is(err, git.ErrRepositoryNotExists) {
+		return git.Init(storer, worktree)
+	}
+	return repo, err
+}
+
+// setOrigin points the origin remote of the repository to url.
+func setOrigin(repo *git.Repository, url string) error {
+	cfg, err := repo.Config()
+	if err != nil {
+		return err
+	}
+	if origin, ok := cfg.Remotes["origin"]; ok && slices.Equal(origin.URLs, []string{url}) {
+		return nil
+	}
+
+	cfg.Remotes["origin"] = &config.RemoteConfig{
+		Name:  "origin",
+		URLs:  []string{url},
+		Fetch: []config.RefSpec{"+refs/heads/*:refs/remotes/origin/*"},
+	}
+	return repo.SetConfig(cfg)
+}
+
+// checkoutSubmodule resets the worktree of the submodule to the commit, or
+// writes the commit into dir for a published revision.
+func checkoutSubmodule(ctx context.Context, repo *git.Repository, hash plumbing.Hash, dir string, inPlace bool) error {
+	if !inPlace {
+		commit, err := repo.CommitObject(hash)
+		if err != nil {
+			return err
+		}
+		return writeTree(ctx, commit, SparseOptions{}, nil, dir)
+	}
+
+	w, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	return w.Checkout(&git.CheckoutOptions{Hash: hash, Force: true})
+}
@@ -0,0 +1,145 @@
+package syncer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/stretchr/testify/require"
+)
+
+// Submodule points the submodule at path of the remote to the commit of sub,
+// using a URL relative to the remote, and returns the new commit hash.
+func (r *testRemote) Submodule(path string, sub *testRemote, hash string) string {
+	r.t.Helper()
+
+	rel, err := filepath.Rel(r.Path, sub.Path)
+	require.NoError(r.t, err)
+	url := "../" + filepath.ToSlash(rel) + "/.git"
+
+	idx, err := r.repo.Storer.Index()
+	require.NoError(r.t, err)
+	entry, err := idx.Entry(path)
+	if err != nil {
+		entry = idx.Add(path)
+	}
+	entry.Mode = filemode.Submodule
+	entry.Hash = plumbing.NewHash(hash)
+	require.NoError(r.t, r.repo.Storer.SetIndex(idx))
+	require.NoError(r.t, os.MkdirAll(filepath.Join(r.Path, path), 0o755))
+
+	return r.Commit(map[string]string{".gitmodules": fmt.Sprintf("[submodule %q]\n\tpath = %s\n\turl = %s\n", path, path, url)})
+}
+
+func requireContent(t *testing.T, path string, content string) {
+	t.Helper()
+
+	actual, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, content, string(actual))
+}
+
+func TestSubmodules(t *testing.T) {
+	nested := newTestRemote(t)
+	shared := newTestRemote(t)
+	shared.Submodule("nested", nested, nested.Commit(map[string]string{"nested.txt": "nested"}))
+	sharedHash := shared.Commit(map[string]string{"config.yaml": "v1"})
+	remote := newTestRemote(t)
+	remote.Submodule("vendor/shared", shared, sharedHash)
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.Submodules = SubmoduleOptions{Enabled: true, MaxDepth: 1}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "vendor", "shared", "config.yaml"), "v1")
+	require.NoFileExists(t, filepath.Join(path, "vendor", "shared", "nested", "nested.txt"), "beyond the max depth")
+	submodules := s.Status().Submodules
+	require.Len(t, submodules, 1)
+	require.Equal(t, "vendor/shared", submodules[0].Path)
+	require.Equal(t, filepath.Join(shared.Path, ".git"), submodules[0].URL)
+	require.Equal(t, sharedHash, submodules[0].Commit)
+
+	// A new commit of the submodule is checked out, with nested submodules.
+	sharedHash = shared.Commit(map[string]string{"config.yaml": "v2"})
+	remote.Submodule("vendor/shared", shared, sharedHash)
+	s.Options.Submodules.MaxDepth = 0
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "vendor", "shared", "config.yaml"), "v2")
+	requireContent(t, filepath.Join(path, "vendor", "shared", "nested", "nested.txt"), "nested")
+	submodules = s.Status().Submodules
+	require.Len(t, submodules, 2)
+	require.Equal(t, sharedHash, submodules[0].Commit)
+	require.Equal(t, "vendor/shared/nested", submodules[1].Path)
+
+	s.Options.Submodules.AllowedURLs = []string{"https://example.com/*"}
+	require.ErrorIs(t, s.ForceSync(), ErrSubmoduleNotAllowed)
+}
+
+func TestSubmodulesPublish(t *testing.T) {
+	shared := newTestRemote(t)
+	sharedHash := shared.Commit(map[string]string{"config.yaml": "v1"})
+	remote := newTestRemote(t)
+	remote.Submodule("vendor/shared", shared, sharedHash)
+
+	root := t.TempDir()
+	opts := remote.Options(filepath.Join(root, "current"))
+	opts.Publish = PublishOptions{Root: filepath.Join(root, "revs")}
+	opts.Submodules = SubmoduleOptions{Enabled: true, AllowedURLs: []string{filepath.Join(shared.Path, "*")}}
+	s := NewSyncer(opts)
+
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(opts.Path, "vendor", "shared", "config.yaml"), "v1")
+	require.Len(t, s.Status().Submodules, 1)
+}
+
+func TestSubmodulesDepth(t *testing.T) {
+	useGitBinary(t)
+	shared := newTestRemote(t)
+	oldHash := shared.Commit(map[string]string{"config.yaml": "v1"})
+	sharedHash := shared.Commit(map[string]string{"config.yaml": "v2"})
+	remote := newTestRemote(t)
+	remote.Submodule("vendor/shared", shared, sharedHash)
+
+	path := filepath.Join(t.TempDir(), "repo")
+	opts := remote.Options(path)
+	opts.Depth = 1
+	opts.Submodules = SubmoduleOptions{Enabled: true}
+	s := NewSyncer(opts)
+
+	// The submodule is cloned with the depth of the repository.
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "vendor", "shared", "config.yaml"), "v2")
+	parent, err := git.PlainOpen(path)
+	require.NoError(t, err)
+	storer, err := parent.Storer.Module("vendor/shared")
+	require.NoError(t, err)
+	shallow, err := storer.Shallow()
+	require.NoError(t, err)
+	require.Equal(t, []plumbing.Hash{plumbing.NewHash(sharedHash)}, shallow)
+
+	// A commit outside the shallow history is fetched with the history.
+	remote.Submodule("vendor/shared", shared, oldHash)
+	require.NoError(t, s.ForceSync())
+	requireContent(t, filepath.Join(path, "vendor", "shared", "config.yaml"), "v1")
+}
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	for _, tc := range []struct {
+		parent, url, expected string
+	}{
+		{"https://github.com/org/app.git", "../shared.git", "https://github.com/org/shared.git"},
+		{"https://github.com/org/app.git", "./shared.git", "https://github.com/org/app.git/shared.git"},
+		{"https://github.com", "../shared.git", "https://github.com/shared.git"},
+		{"git@github.com:org/app.git", "../shared.git", "git@github.com:org/shared.git"},
+		{"/srv/git/app.git", "../shared.git", "/srv/git/shared.git"},
+		{"https://github.com/org/app.git", "https://example.com/shared.git", "https://example.com/shared.git"},
+	} {
+		require.Equal(t, tc.expected, resolveSubmoduleURL(tc.parent, tc.url), "%s %s", tc.parent, tc.url)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"slices"
 	"sync"
 	"time"
 
@@ -20,6 +22,12 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
+func init() {
+	transport.UnsupportedCapabilities = []capability.Capability{
+		capability.ThinPack,
+	}
+}
+
 type AuthOptions struct {
 	Repo              string
 	Username          string
@@ -31,39 +39,192 @@ type AuthOptions struct {
 }
 
 type SyncOptions struct {
-	Path         string
+	Path string
+	// RefName is the branch or tag to track, or a semver constraint prefixed
+	// with SemverRefPrefix to track the highest matching tag.
 	RefName      plumbing.ReferenceName
 	CABuntleFile string
 	PollInterval time.Duration
 	Auth         AuthOptions
+	Publish      PublishOptions
+	Hooks        HookOptions
+	// Notifications receive a POST for every sync event they subscribe to.
+	Notifications []Notification
+	// IncludePrerelease lets a semver RefName match pre-release tags.
+	IncludePrerelease bool
+	Timeouts          Timeouts
+	Retry             RetryPolicy
+	// QuarantineDir is where Quarantine moves broken clones. Defaults to a
+	// .git-sync-quarantine directory next to the clone.
+	QuarantineDir string
+	// QuarantineKeep is the number of quarantined clones of the repo kept,
+	// the oldest are removed. Zero means DefaultQuarantineKeep, a negative
+	// value keeps all of them.
+	QuarantineKeep int
+	// StateFile is where the status is saved after every sync and restored
+	// from by NewSyncer. Defaults to StateFile in the .git directory of the
+	// clone.
+	StateFile string
+	History   HistoryOptions
+	// Depth limits clones and fetches to that many commits from the tip of
+	// each reference. Zero fetches the complete history.
+	Depth int
+	// Filter makes the clone partial: blob:none or blob:limit=<n>[k|m|g]
+	// leaves blobs on the server until a checkout reads them, see ParseFilter.
+	// The server has to support filters, or every blob is fetched.
+	Filter     string
+	Sparse     SparseOptions
+	Submodules SubmoduleOptions
+	LFS        LFSOptions
+}
+
+// Timeouts limit the phases of a sync. A zero value means no limit.
+type Timeouts struct {
+	Clone time.Duration
+	// Fetch also limits the fetch done when switching branches.
+	Fetch time.Duration
+	// Checkout limits the checkout of the worktree, or of a published
+	// revision. A published revision stops between two files, the checkout
+	// of the worktree before it writes the first one.
+	Checkout time.Duration
 }
 
+var (
+	// ErrSyncCanceled is returned by syncs stopped with Cancel.
+	ErrSyncCanceled = errors.New("sync canceled")
+	// ErrNoSyncInProgress is returned by Cancel when there is nothing to
+	// cancel.
+	ErrNoSyncInProgress = errors.New("no sync in progress")
+	// ErrSyncerClosed is returned by syncs requested after Shutdown.
+	ErrSyncerClosed = errors.New("syncer is shut down")
+)
+
 type SyncStatus struct {
 	LastChecked time.Time `json:"last_checked"`
 	LastUpdated time.Time `json:"last_updated"`
-	LatestHash  string    `json:"latest_commit"`
+	// LastSuccess is the time the last sync succeeded.
+	LastSuccess time.Time `json:"last_success,omitzero"`
+	// LastSyncDuration is the duration of the last sync, whether it failed or
+	// not.
+	LastSyncDuration time.Duration `json:"last_sync_duration"`
+	// NextPoll is the time of the next scheduled sync, zero when not polling.
+	NextPoll time.Time `json:"next_poll,omitzero"`
+	// CircuitOpenUntil is set while polling pauses after repeated
+	// authentication or host key failures, see RetryPolicy.
+	CircuitOpenUntil time.Time `json:"circuit_open_until,omitzero"`
+	// InProgress is set while a sync runs, SyncStarted is when it started.
+	InProgress  bool      `json:"in_progress"`
+	SyncStarted time.Time `json:"sync_started,omitzero"`
+	// Phase is the step the current sync is in, or PhaseIdle.
+	Phase string `json:"phase"`
+	// LastError is the error of the last failed sync. It is kept after the
+	// syncs succeed again, ConsecutiveFailures tells whether it is current.
+	LastError           string    `json:"last_error,omitempty"`
+	LastErrorTime       time.Time `json:"last_error_time,omitzero"`
+	ConsecutiveFailures int       `json:"consecutive_failures"`
+	// Degraded is set while the last sync failed and the worktree of an
+	// earlier sync is served, see Health.
+	Degraded   bool   `json:"degraded"`
+	LatestHash string `json:"latest_commit"`
+	// Commit describes LatestHash.
+	Commit       *CommitInfo `json:"commit,omitempty"`
+	PreviousHash string      `json:"previous_commit,omitempty"`
+	RemoteHash   string      `json:"remote_commit,omitempty"`
+	PinnedHash   string      `json:"pinned_commit,omitempty"`
+	// ResolvedRef is the tag a semver RefName resolved to.
+	ResolvedRef string `json:"resolved_ref,omitempty"`
+	// Hooks are the results of the hooks run for the last commit change.
+	Hooks []HookResult `json:"hooks,omitempty"`
+	// Submodules are the submodules checked out for LatestHash.
+	Submodules []SubmoduleStatus `json:"submodules,omitempty"`
+	// CommitsBehind is the number of commits the pinned commit is behind the
+	// remote, or -1 when the pinned commit is not in the remote history.
+	CommitsBehind int `json:"commits_behind,omitempty"`
+	// Notifications are the results of the latest notification deliveries,
+	// oldest first.
+	Notifications []NotificationDelivery `json:"notifications,omitempty"`
+	// Fetch tells how much a partial clone left on the server.
+	Fetch FetchStats `json:"fetch,omitzero"`
 }
 
 type Syncer struct {
-	Options       SyncOptions
-	status        SyncStatus
-	statusLock    sync.Mutex
+	Options SyncOptions
+	// status is the state of the Syncer. It is only used by the sync holding
+	// syncLock, readers get the copy in published.
+	status   SyncStatus
+	syncLock sync.Mutex
+	// statusLock guards published, nextPoll, the circuit state, running,
+	// queued and history. It is never held during network or disk I/O.
+	statusLock       sync.Mutex
+	published        SyncStatus
+	nextPoll         time.Time
+	authFailures     int
+	circuitOpenUntil time.Time
+	// running is the sync in progress, queued is the sync waiting for it to
+	// finish.
+	running *syncCall
+	queued  *syncCall
+	history []HistoryEntry
+	// closed is set by Shutdown.
+	closed        bool
 	pollingCtx    context.Context
 	pollingCancel context.CancelFunc
+	pollingDone   chan struct{}
+	limiter       chan struct{}
+	// name is the name of the Syncer in its Manager.
+	name string
+	// diskChecked is set once the status was compared with the worktree on
+	// disk, which a restored status may not match. It is guarded by syncLock.
+	diskChecked bool
+	// restoredHash is the commit the restored status says is deployed, until
+	// the first checkout. It is guarded by syncLock.
+	restoredHash string
+	// worktree is what the worktree was last checked out at, nil until the
+	// first checkout of the Syncer succeeds. It is guarded by syncLock.
+	worktree *worktreeState
+
+	// Deliveries finish in the background, so they have their own lock.
+	deliveries     []NotificationDelivery
+	deliveriesLock sync.Mutex
+	// delivering tracks the deliveries in progress, which deliveryCancel
+	// stops.
+	delivering     sync.WaitGroup
+	deliveryCtx    context.Context
+	deliveryCancel context.CancelFunc
 }
 
+// NewSyncer creates a Syncer, restoring the status saved by an earlier run.
 func NewSyncer(options SyncOptions) *Syncer {
-	return &Syncer{
+	s := &Syncer{
 		Options:    options,
-		status:     SyncStatus{},
+		status:     SyncStatus{Phase: PhaseIdle},
 		statusLock: sync.Mutex{},
+		published:  SyncStatus{Phase: PhaseIdle},
 	}
+	s.deliveryCtx, s.deliveryCancel = context.WithCancel(context.Background())
+	s.restoreState()
+	return s
 }
 
+// Status returns the status as of the last step of the current sync, or of
+// the last sync. It does not wait for a sync in progress.
 func (s *Syncer) Status() SyncStatus {
 	s.statusLock.Lock()
-	defer s.statusLock.Unlock()
-	return s.status
+	status := s.published
+	status.NextPoll = s.nextPoll
+	if time.Now().Before(s.circuitOpenUntil) {
+		status.CircuitOpenUntil = s.circuitOpenUntil
+	}
+	if s.running != nil {
+		status.InProgress = true
+		status.SyncStarted = s.running.started
+	}
+	s.statusLock.Unlock()
+
+	s.deliveriesLock.Lock()
+	status.Notifications = slices.Clone(s.deliveries)
+	s.deliveriesLock.Unlock()
+	return status
 }
 
 func (s *Syncer) Start() {
@@ -75,29 +236,75 @@ func (s *Syncer) Start() {
 
 	s.pollingCtx = ctx
 	s.pollingCancel = cancel
+	s.pollingDone = make(chan struct{})
 
-	go s.startPolling(ctx)
+	go func() {
+		defer close(s.pollingDone)
+		s.startPolling(ctx)
+	}()
 }
 
+// Stop stops polling and waits for a sync started by polling to return.
 func (s *Syncer) Stop() {
+	if s.pollingCancel == nil {
+		return
+	}
+
 	s.pollingCancel()
+	<-s.pollingDone
 	s.pollingCtx = nil
 	s.pollingCancel = nil
+	s.pollingDone = nil
+
+	s.statusLock.Lock()
+	s.nextPoll = time.Time{}
+	s.statusLock.Unlock()
+}
+
+// Update replaces the options of the Syncer. If the Syncer is polling, polling
+// is restarted with the new options.
+func (s *Syncer) Update(options SyncOptions) {
+	running := s.pollingCancel != nil
+	s.Stop()
+
+	s.syncLock.Lock()
+	s.Options = options
+	s.syncLock.Unlock()
+
+	if running {
+		s.Start()
+	}
 }
 
 func (s *Syncer) startPolling(ctx context.Context) {
-	ticker := time.NewTicker(s.Options.PollInterval)
-	defer ticker.Stop()
+	// The first poll is jittered too, so replicas started together spread
+	// out right away.
+	delay := s.Options.Retry.withJitter(s.Options.PollInterval)
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	s.setNextPoll(time.Now().Add(delay))
 
 	log.Printf("Starting Polling on Repo: %s", s.Options.Auth.Repo)
 
 	for {
 		select {
-		case <-ticker.C:
-			err := s.syncRepo(ctx, false)
+		case <-timer.C:
+			var err error
+			if _, open := s.circuitOpen(); open {
+				log.Printf("Circuit open, skipping poll of Repo: %s", s.Options.Auth.Repo)
+			} else {
+				err = s.syncRepo(ctx, false)
+			}
+			if errors.Is(err, ErrSyncerClosed) {
+				return
+			}
 			if err != nil {
 				log.Printf("Error Syncing Repo: %s\n%v", s.Options.Auth.Repo, err)
 			}
+
+			delay = s.pollDelay(err)
+			timer.Reset(delay)
+			s.setNextPoll(time.Now().Add(delay))
 		case <-ctx.Done():
 			log.Printf("Stopping Polling on Repo: %s", s.Options.Auth.Repo)
 			return
@@ -105,93 +312,518 @@ func (s *Syncer) startPolling(ctx context.Context) {
 	}
 }
 
+// Shutdown stops the Syncer for good. It waits for the sync in progress, and
+// the one waiting for it, to finish, and then for the notification deliveries
+// in progress. If ctx is done first they are canceled, which stops syncs at
+// the next point where the worktree is consistent, and ctx.Err() is returned
+// once they returned. Later syncs fail with ErrSyncerClosed.
+func (s *Syncer) Shutdown(ctx context.Context) error {
+	s.statusLock.Lock()
+	s.closed = true
+	var calls []*syncCall
+	for _, call := range []*syncCall{s.running, s.queued} {
+		if call != nil {
+			calls = append(calls, call)
+		}
+	}
+	s.statusLock.Unlock()
+
+	var err error
+	for _, call := range calls {
+		select {
+		case <-call.done:
+			continue
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		s.statusLock.Lock()
+		call.canceled = true
+		call.cancel()
+		s.statusLock.Unlock()
+		<-call.done
+	}
+
+	s.Stop()
+	if waitErr := s.waitDeliveries(ctx); err == nil {
+		err = waitErr
+	}
+	return err
+}
+
+// ForceSync syncs the repo and waits for the result. If a sync is in progress
+// but has not started fetching yet, or is waiting for the one in progress,
+// ForceSync joins it instead of queueing another one.
 func (s *Syncer) ForceSync() error {
-	return s.syncRepo(context.Background(), true)
+	return s.ForceSyncContext(context.Background())
 }
 
+// ForceSyncContext is ForceSync, but stops waiting when ctx is done. The sync
+// itself is canceled once every caller waiting for it has given up.
+func (s *Syncer) ForceSyncContext(ctx context.Context) error {
+	return s.syncRepo(ctx, true)
+}
+
+// Cancel cancels the sync in progress. Its callers get an error wrapping
+// ErrSyncCanceled. A sync waiting for the one in progress is not affected.
+func (s *Syncer) Cancel() error {
+	s.statusLock.Lock()
+	defer s.statusLock.Unlock()
+
+	if s.running == nil {
+		return ErrNoSyncInProgress
+	}
+
+	log.Printf("Canceling sync of Repo: %s", s.Options.Auth.Repo)
+	s.running.canceled = true
+	s.running.cancel()
+	return nil
+}
+
+// syncRepo runs a sync once the sync in progress, if any, has finished.
+// Callers join a sync that has not started fetching yet, so every caller gets
+// a sync that fetches after it was called, while at most one sync waits at a
+// time.
+//
+// The sync runs in its own goroutine with its own context, which is canceled
+// when the last caller waiting for it returns early. That caller waits for the
+// sync to wind down, so Stop still returns after the sync polling started.
 func (s *Syncer) syncRepo(ctx context.Context, forcePull bool) error {
-	transport.UnsupportedCapabilities = []capability.Capability{
-		capability.ThinPack,
+	s.statusLock.Lock()
+	if s.closed {
+		s.statusLock.Unlock()
+		return ErrSyncerClosed
+	}
+	call := s.queued
+	if call == nil && s.running != nil && !s.running.fetching && s.running.ctx.Err() == nil {
+		call = s.running
+	}
+	if call != nil {
+		call.forcePull = call.forcePull || forcePull
+		call.joined++
+	} else {
+		callCtx, cancel := context.WithCancel(context.Background())
+		call = &syncCall{done: make(chan struct{}), ctx: callCtx, cancel: cancel, forcePull: forcePull}
+		s.queued = call
+		go func() {
+			defer close(call.done)
+			defer cancel()
+			call.err = s.runCall(callCtx, call)
+		}()
+	}
+	call.waiters++
+	s.statusLock.Unlock()
+
+	select {
+	case <-call.done:
+		return call.err
+	case <-ctx.Done():
 	}
 
 	s.statusLock.Lock()
-	defer s.statusLock.Unlock()
+	call.waiters--
+	last := call.waiters == 0
+	if last {
+		if s.queued == call {
+			s.queued = nil
+		}
+		call.cancel()
+	}
+	s.statusLock.Unlock()
+
+	if last {
+		<-call.done
+	}
+	return ctx.Err()
+}
+
+func (s *Syncer) runCall(ctx context.Context, call *syncCall) error {
+	s.syncLock.Lock()
+	defer s.syncLock.Unlock()
+
+	// Every caller gave up while the sync was queued.
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.statusLock.Lock()
+	s.queued = nil
+	s.running = call
+	call.started = time.Now()
+	s.statusLock.Unlock()
+
+	defer func() {
+		s.status.Phase = PhaseIdle
+		s.publish()
+
+		s.statusLock.Lock()
+		s.running = nil
+		s.statusLock.Unlock()
+	}()
+
+	s.statusLock.Lock()
+	forcePull := call.forcePull
+	s.statusLock.Unlock()
+
+	oldHash := s.status.LatestHash
+	change, err := s.runSync(ctx, forcePull)
+	err = s.canceledError(call, classify(err))
+	s.recordResult(call.started, err)
+	s.recordHistory(call.started, oldHash, change, err)
+	s.updateCircuit(err)
+	s.recordSync(err)
+	s.notify(change, err)
+	s.saveState()
+	return err
+}
+
+// acquireSlot waits for a slot of the Manager's limit on concurrent clones
+// and fetches, and then moves the sync to phase. The caller releases the slot
+// once the clone or fetch is done. Callers no longer join a sync that got a
+// slot, as it is talking to the remote.
+func (s *Syncer) acquireSlot(ctx context.Context, phase string) error {
+	s.setPhase(PhaseWaiting)
+	if err := acquire(ctx, s.limiter); err != nil {
+		return fmt.Errorf("waiting for sync slot: %w", err)
+	}
+
+	s.statusLock.Lock()
+	if s.running != nil {
+		s.running.fetching = true
+	}
+	s.statusLock.Unlock()
+	s.setPhase(phase)
+	return nil
+}
+
+// canceledError marks the error of a sync stopped with Cancel.
+func (s *Syncer) canceledError(call *syncCall, err error) error {
+	s.statusLock.Lock()
+	canceled := call.canceled
+	s.statusLock.Unlock()
+
+	if err == nil || !canceled {
+		return err
+	}
+	return fmt.Errorf("%w: %w", ErrSyncCanceled, err)
+}
 
+// phaseContext limits ctx to the timeout of a phase. A zero timeout leaves
+// the deadline of ctx unchanged.
+func phaseContext(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// phaseError reports an error caused by the timeout of a phase as such, as
+// transports do not always wrap the context error.
+func phaseError(ctx context.Context, phase string, timeout time.Duration, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("%s timed out after %s: %w: %w", phase, timeout, context.DeadlineExceeded, err)
+}
+
+// runSync brings the worktree to the tracked commit and returns the commit
+// change it applied, or nil when the commit did not change.
+func (s *Syncer) runSync(ctx context.Context, forcePull bool) (*hookEvent, error) {
 	s.status.LastChecked = time.Now()
+	s.status.Fetch.ReceivedBytes, s.status.Fetch.FetchedBlobs = 0, 0
 
 	var repo *git.Repository
 	var err error
+	cloned := false
 
 	log.Println("Looking for Repo locally...")
 	repo, err = openRepo(s.Options)
 
 	switch {
 	case errors.Is(err, git.ErrRepositoryNotExists) || os.IsNotExist(err):
+		// A restored status describes a worktree that is gone.
+		s.status.LatestHash = ""
+		s.status.Commit = nil
+		s.restoredHash = ""
+		s.diskChecked = true
+
 		log.Println("Repo not found, Cloning...")
-		repo, err = cloneRepo(ctx, s.Options)
+		if err = s.acquireSlot(ctx, PhaseCloning); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		cloneCtx, cancel := phaseContext(ctx, s.Options.Timeouts.Clone)
+		repo, err = cloneRepo(cloneCtx, s.Options, &s.status.Fetch)
+		err = phaseError(cloneCtx, OperationClone, s.Options.Timeouts.Clone, err)
+		cancel()
+		release(s.limiter)
+		s.observe(OperationClone, start)
 		if err != nil {
-			return fmt.Errorf("clone failed: %w", err)
+			return nil, fmt.Errorf("clone failed: %w", err)
 		}
+		cloned = true
 
 		log.Println("Cloning Completed.")
 	case err != nil:
-		return fmt.Errorf("failed to open repo: %w", err)
+		return nil, classified(ErrWorktreeCorrupt, fmt.Errorf("failed to open repo: %w", err))
 	default:
+		// The worktree left by an earlier run is served until a sync
+		// succeeds. The status is empty or restored from the state file, so
+		// the worktree on disk tells which commit that is.
+		if !s.diskChecked {
+			s.diskChecked = true
+			if hash := s.worktreeCommit(repo); !hash.IsZero() && hash.String() != s.status.LatestHash {
+				s.status.LatestHash = hash.String()
+				s.restoredHash = ""
+				s.updateCommitInfo(repo)
+			}
+		}
+
 		// if repo already exists, make sure the target branch hasn't changed.
-		err = switchReference(ctx, repo, s.Options)
+		err = s.switchReference(ctx, repo)
 		if err != nil {
-			return fmt.Errorf("failed to switch branch: %w", err)
+			return nil, fmt.Errorf("failed to switch branch: %w", err)
 		}
 	}
 
+	if err = s.markManaged(repo, cloned); err != nil {
+		return nil, fmt.Errorf("failed to write marker: %w", err)
+	}
+
 	log.Println("Fetching Repo...")
-	err = fetchRepo(ctx, repo, s.Options)
+	if err = s.acquireSlot(ctx, PhaseFetching); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	fetchCtx, cancel := phaseContext(ctx, s.Options.Timeouts.Fetch)
+	err = fetchRepo(fetchCtx, repo, s.Options, s.Options.Depth, &s.status.Fetch)
+	err = phaseError(fetchCtx, OperationFetch, s.Options.Timeouts.Fetch, err)
+	cancel()
+	release(s.limiter)
+	s.observe(OperationFetch, start)
 	if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
-		return fmt.Errorf("fetch failed: %w", err)
+		return nil, fmt.Errorf("fetch failed: %w", err)
 	}
 	log.Println("Fetch Completed.")
 
-	ref, err := repo.Reference(plumbing.NewRemoteReferenceName("origin", s.Options.RefName.Short()), true)
+	refName, remote, err := resolveRemote(repo, s.Options)
 	if err != nil {
-		return fmt.Errorf("reference error: %w", err)
+		return nil, fmt.Errorf("reference error: %w", err)
 	}
 
-	w, err := repo.Worktree()
+	s.status.RemoteHash = remote.String()
+	if isSemverRef(s.Options.RefName) {
+		if refName.String() != s.status.ResolvedRef {
+			log.Printf("Resolved %s to %s", s.Options.RefName, refName)
+		}
+		s.status.ResolvedRef = refName.String()
+	}
+
+	target := remote
+	s.status.CommitsBehind = 0
+	if s.status.PinnedHash != "" {
+		target = plumbing.NewHash(s.status.PinnedHash)
+		if s.Options.Depth > 0 {
+			if err = s.deepen(ctx, repo, remote, target); err != nil {
+				return nil, err
+			}
+		}
+		s.status.CommitsBehind = commitsBehind(repo, remote, target)
+	}
+
+	deployed := plumbing.ZeroHash
+	if !cloned {
+		deployed = s.deployedCommit(repo)
+	}
+	if target == deployed {
+		s.setPhase(PhaseCheckingOut)
+		err = s.checkout(ctx, repo, target, forcePull)
+		s.updateCommitInfo(repo)
+		return nil, err
+	}
+
+	event := hookEvent{RefName: refName, OldHash: deployed, NewHash: target}
+	// Without hooks the files are only counted for the history, so a target
+	// that cannot be listed is left to fail the checkout.
+	event.ChangedFiles, err = changedFiles(repo, deployed, target)
+	if err != nil && (len(s.Options.Hooks.PreSync) > 0 || len(s.Options.Hooks.PostSync) > 0) {
+		return nil, fmt.Errorf("failed to list changed files: %w", err)
+	}
+	s.status.Hooks = nil
+
+	// A new clone in place has already written the worktree, so there is
+	// nothing left for a pre-sync hook to guard.
+	if !cloned || s.Options.Publish.Enabled() {
+		s.setPhase(PhaseRunningHooks)
+		err = s.runHooks(ctx, HookPhasePreSync, s.Options.Hooks.PreSync, event)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	s.setPhase(PhaseCheckingOut)
+	err = s.checkout(ctx, repo, target, forcePull)
+	s.updateCommitInfo(repo)
 	if err != nil {
-		return fmt.Errorf("failed to get worktree: %w", err)
+		return nil, err
 	}
 
-	hash := ref.Hash().String()
-	if forcePull || hash != s.status.LatestHash {
-		log.Println("Updating repo to latest commit", hash)
-		err = pullRepo(ctx, w, s.Options)
-		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
-			return fmt.Errorf("pull failed: %w", err)
+	// The update succeeded, so a failing post-sync hook is only recorded.
+	s.setPhase(PhaseRunningHooks)
+	_ = s.runHooks(ctx, HookPhasePostSync, s.Options.Hooks.PostSync, event)
+	return &event, nil
+}
+
+// deployedCommit returns the commit currently in the worktree, or the zero
+// hash if it is not known.
+func (s *Syncer) deployedCommit(repo *git.Repository) plumbing.Hash {
+	if s.status.LatestHash != "" {
+		return plumbing.NewHash(s.status.LatestHash)
+	}
+	return s.worktreeCommit(repo)
+}
+
+// worktreeCommit reads the commit in the worktree, or the published
+// revision, from disk. It returns the zero hash if it cannot tell.
+func (s *Syncer) worktreeCommit(repo *git.Repository) plumbing.Hash {
+	if s.Options.Publish.Enabled() {
+		current, err := publishedRevision(s.Options.Path)
+		if err != nil {
+			return plumbing.ZeroHash
 		}
-		s.status.LatestHash = hash
-		s.status.LastUpdated = time.Now()
-		log.Println("Update Completed.")
+		hash, _ := revisionHash(filepath.Base(current))
+		return plumbing.NewHash(hash)
+	}
+
+	head, err := repo.Head()
+	if err != nil {
+		return plumbing.ZeroHash
+	}
+	return head.Hash()
+}
+
+// checkout runs updateWorktree, and the update of the submodules, within
+// the checkout timeout.
+func (s *Syncer) checkout(ctx context.Context, repo *git.Repository, target plumbing.Hash, forcePull bool) error {
+	ctx, cancel := phaseContext(ctx, s.Options.Timeouts.Checkout)
+	defer cancel()
+
+	err := s.updateWorktree(ctx, repo, target, forcePull)
+	if err == nil {
+		s.restoredHash = ""
+	}
+	// Published revisions get their submodules when they are checked out.
+	if err == nil && !s.Options.Publish.Enabled() {
+		err = s.updateSubmodules(ctx, repo, target, s.Options.Path, true)
+	}
+	return phaseError(ctx, "checkout", s.Options.Timeouts.Checkout, err)
+}
+
+// updateWorktree brings the worktree, or the published revision, to target.
+func (s *Syncer) updateWorktree(ctx context.Context, repo *git.Repository, target plumbing.Hash, forcePull bool) error {
+	if s.Options.Publish.Enabled() {
+		defer s.observe(OperationPublish, time.Now())
+		return s.publishRevision(ctx, repo, target, forcePull)
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	changed := target.String() != s.status.LatestHash
+	// A forced sync of a branch counts as an update without a new commit too.
+	update := changed || forcePull && s.status.PinnedHash == "" && s.Options.RefName.IsBranch()
+	operation := OperationReset
+	if update {
+		log.Println("Updating repo to commit", target)
+		operation = OperationPull
 	} else {
 		log.Println("No changes.")
+	}
+
+	// The commit is fetched already, so unlike a pull the checkout needs
+	// neither the network nor the history between the commits.
+	start := time.Now()
+	err := s.checkoutWorktree(ctx, repo, target)
+	s.observe(operation, start)
+	if err != nil {
+		return fmt.Errorf("checkout failed: %w", err)
+	}
+
+	if update {
+		s.setLatest(target.String())
+		log.Println("Update Completed.")
+	}
+	return nil
+}
+
+// setLatest records hash as the current commit, remembering the one it
+// replaces. Checking out the commit deployed before a restart again is not an
+// update.
+func (s *Syncer) setLatest(hash string) {
+	if hash == s.restoredHash {
+		return
+	}
+	if hash != s.status.LatestHash {
+		if s.status.LatestHash != "" {
+			s.status.PreviousHash = s.status.LatestHash
+		}
+		s.status.LatestHash = hash
+	}
+	s.status.LastUpdated = time.Now()
+}
 
-		// Manually reset the worktree to match the latest commit fully
-		// This is to handle any cases where local did not complete extract, but git commit is pulled
-		err = w.Reset(&git.ResetOptions{
-			Mode:   git.HardReset,
-			Commit: ref.Hash(),
-		})
+// resolveRemote returns the reference to sync and the commit it points to.
+// Branches resolve to their remote tracking reference, tags to the commit
+// they tag and semver refs to the highest matching tag.
+func resolveRemote(repo *git.Repository, opts SyncOptions) (plumbing.ReferenceName, plumbing.Hash, error) {
+	refName := opts.RefName
+
+	constraint, err := ParseSemverConstraint(refName)
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+	if constraint != nil {
+		refName, err = resolveSemverTag(repo, constraint, opts.IncludePrerelease)
 		if err != nil {
-			return fmt.Errorf("reset branch failed: %w", err)
+			return "", plumbing.ZeroHash, err
 		}
 	}
 
-	return nil
+	lookup := refName
+	if refName.IsBranch() {
+		lookup = plumbing.NewRemoteReferenceName("origin", refName.Short())
+	}
+
+	ref, err := repo.Reference(lookup, true)
+	if err != nil {
+		return "", plumbing.ZeroHash, err
+	}
+
+	// Annotated tags point to a tag object rather than the commit.
+	hash := ref.Hash()
+	if tag, err := repo.TagObject(hash); err == nil {
+		commit, err := tag.Commit()
+		if err != nil {
+			return "", plumbing.ZeroHash, err
+		}
+		hash = commit.Hash
+	}
+
+	return refName, hash, nil
 }
 
-func switchReference(ctx context.Context, repo *git.Repository, opts SyncOptions) error {
+func (s *Syncer) switchReference(ctx context.Context, repo *git.Repository) error {
+	opts := s.Options
+	// Tags and semver refs are checked out by commit after each fetch, so
+	// there is no branch to switch to.
+	if !opts.RefName.IsBranch() {
+		return nil
+	}
+
 	headRef, err := repo.Head()
 	if err != nil {
-		return fmt.Errorf("failed to get HEAD reference: %w", err)
+		return classified(ErrWorktreeCorrupt, fmt.Errorf("failed to get HEAD reference: %w", err))
 	}
 
 	currentRef := headRef.Name().String()
@@ -199,7 +831,20 @@ func switchReference(ctx context.Context, repo *git.Repository, opts SyncOptions
 		log.Printf("Switching from reference %s to %s", currentRef, opts.RefName.String())
 
 		log.Println("Fetching Repo to get remote references...")
-		err = fetchRepo(ctx, repo, opts)
+		if err = s.acquireSlot(ctx, PhaseFetching); err != nil {
+			return err
+		}
+		fetchCtx, cancel := phaseContext(ctx, opts.Timeouts.Fetch)
+		err = fetchRepo(fetchCtx, repo, opts, opts.Depth, &s.status.Fetch)
+		if opts.Depth > 0 && shallowFetchFailed(fetchCtx, err) {
+			// The new reference shares no history with the shallow one, so
+			// fall back to the complete history rather than failing the switch.
+			log.Printf("Shallow fetch failed, fetching the complete history: %v", err)
+			err = fetchRepo(fetchCtx, repo, opts, unshallowDepth, &s.status.Fetch)
+		}
+		err = phaseError(fetchCtx, OperationFetch, opts.Timeouts.Fetch, err)
+		cancel()
+		release(s.limiter)
 		if err != nil && !errors.Is(err, git.NoErrAlreadyUpToDate) {
 			return fmt.Errorf("fetch failed: %w", err)
 		}
@@ -208,11 +853,6 @@ func switchReference(ctx context.Context, repo *git.Repository, opts SyncOptions
 		}
 		log.Println("Fetch Completed.")
 
-		w, err := repo.Worktree()
-		if err != nil {
-			return fmt.Errorf("failed to get worktree: %w", err)
-		}
-
 		remoteRefName := plumbing.NewRemoteReferenceName("origin", opts.RefName.Short())
 		//		localRefName := plumbing.NewBranchReferenceName(opts.RefName.Short())
 		//
@@ -233,10 +873,13 @@ func switchReference(ctx context.Context, repo *git.Repository, opts SyncOptions
 		//			Force:  true,
 		//		})
 
-		err = w.Checkout(&git.CheckoutOptions{
-			Branch: remoteRefName,
-			Force:  true,
-		})
+		// Only HEAD moves here, like for a checkout of the remote reference
+		// by git, the sync then checks out the files of the new reference.
+		remoteRef, err := repo.Reference(remoteRefName, true)
+		if err != nil {
+			return fmt.Errorf("checkout failed: %w", err)
+		}
+		err = repo.Storer.SetReference(plumbing.NewHashReference(plumbing.HEAD, remoteRef.Hash()))
 		if err != nil {
 			return fmt.Errorf("checkout failed: %w", err)
 		}
@@ -279,8 +922,13 @@ func removeOldBranches(repo *git.Repository) error {
 	return nil
 }
 
-func cloneRepo(ctx context.Context, opts SyncOptions) (*git.Repository, error) {
+// cloneRepo clones the repository, adding the size of a partial clone to
+// stats.
+func cloneRepo(ctx context.Context, opts SyncOptions, stats *FetchStats) (*git.Repository, error) {
 	log.Println("Cloning repository...")
+	if opts.Filter != "" {
+		return clonePartial(ctx, opts, stats)
+	}
 
 	auth, err := createAuthFromOpts(opts.Auth)
 	if err != nil {
@@ -292,13 +940,25 @@ func cloneRepo(ctx context.Context, opts SyncOptions) (*git.Repository, error) {
 		return nil, err
 	}
 
-	repo, err := git.PlainCloneContext(ctx, opts.Path, false, &git.CloneOptions{
+	// A semver ref is only resolved once the tags are fetched, so clone the
+	// default branch and check out the matching tag afterwards.
+	refName := opts.RefName
+	semverRef := isSemverRef(refName)
+	if semverRef {
+		refName = ""
+	}
+
+	repo, err := git.PlainCloneContext(ctx, opts.repoPath(), false, &git.CloneOptions{
 		URL:             opts.Auth.Repo,
-		ReferenceName:   opts.RefName,
+		ReferenceName:   refName,
 		SingleBranch:    true,
+		Depth:           opts.Depth,
 		Auth:            auth,
 		InsecureSkipTLS: opts.Auth.InsecureSkipTLS,
 		CABundle:        caBundle,
+		// In publish mode revisions are checked out into their own
+		// directories, and sparse and LFS worktrees by the first sync.
+		NoCheckout: opts.Publish.Enabled() || semverRef || opts.Sparse.Enabled() || opts.LFS.Enabled,
 	})
 	if err != nil {
 		return nil, err
@@ -308,14 +968,20 @@ func cloneRepo(ctx context.Context, opts SyncOptions) (*git.Repository, error) {
 }
 
 func openRepo(opts SyncOptions) (*git.Repository, error) {
-	repo, err := git.PlainOpen(opts.Path)
+	repo, err := git.PlainOpen(opts.repoPath())
 	if err != nil {
 		return nil, err
 	}
 	return repo, nil
 }
 
-func fetchRepo(ctx context.Context, repo *git.Repository, opts SyncOptions) error {
+// fetchRepo fetches the branches and tags of the remote, adding the size of
+// a partial fetch to stats.
+func fetchRepo(ctx context.Context, repo *git.Repository, opts SyncOptions, depth int, stats *FetchStats) error {
+	if opts.Filter != "" {
+		return fetchPartial(ctx, repo, opts, depth, stats)
+	}
+
 	auth, err := createAuthFromOpts(opts.Auth)
 	if err != nil {
 		return err
@@ -328,6 +994,7 @@ func fetchRepo(ctx context.Context, repo *git.Repository, opts SyncOptions) erro
 
 	err = repo.FetchContext(ctx, &git.FetchOptions{
 		RemoteName:      "origin",
+		Depth:           depth,
 		Auth:            auth,
 		Force:           true,
 		InsecureSkipTLS: opts.Auth.InsecureSkipTLS,
@@ -340,30 +1007,6 @@ func fetchRepo(ctx context.Context, repo *git.Repository, opts SyncOptions) erro
 	return err
 }
 
-func pullRepo(ctx context.Context, worktree *git.Worktree, opts SyncOptions) error {
-	auth, err := createAuthFromOpts(opts.Auth)
-	if err != nil {
-		return err
-	}
-
-	caBundle, err := getCABundleFromFile(opts.CABuntleFile)
-	if err != nil {
-		return err
-	}
-
-	err = worktree.PullContext(ctx, &git.PullOptions{
-		RemoteName:      "origin",
-		SingleBranch:    true,
-		Auth:            auth,
-		Force:           true,
-		InsecureSkipTLS: opts.Auth.InsecureSkipTLS,
-		ReferenceName:   opts.RefName,
-		CABundle:        caBundle,
-	})
-
-	return err
-}
-
 func getCABundleFromFile(path string) ([]byte, error) {
 	if path == "" {
 		return nil, nil
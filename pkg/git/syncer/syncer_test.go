@@ -1 +1,310 @@
 package syncer
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMain(m *testing.M) {
+	// Serve file:// remotes in-process so the tests do not need a git binary.
+	client.InstallProtocol("file", server.NewClient(server.DefaultLoader))
+	os.Exit(m.Run())
+}
+
+type testRemote struct {
+	t    testing.TB
+	Path string
+	repo *git.Repository
+}
+
+func newTestRemote(t testing.TB) *testRemote {
+	t.Helper()
+
+	path := t.TempDir()
+	repo, err := git.PlainInitWithOptions(path, &git.PlainInitOptions{
+		InitOptions: git.InitOptions{DefaultBranch: plumbing.Main},
+	})
+	require.NoError(t, err)
+
+	remote := &testRemote{t: t, Path: path, repo: repo}
+	remote.Commit(map[string]string{"README.md": "initial"})
+	return remote
+}
+
+// Commit writes the files to the remote worktree and commits them, returning
+// the new commit hash.
+func (r *testRemote) Commit(files map[string]string) string {
+	r.t.Helper()
+
+	w, err := r.repo.Worktree()
+	require.NoError(r.t, err)
+
+	for name, content := range files {
+		full := filepath.Join(r.Path, name)
+		require.NoError(r.t, os.MkdirAll(filepath.Dir(full), 0o755))
+		require.NoError(r.t, os.WriteFile(full, []byte(content), 0o600))
+		_, err = w.Add(name)
+		require.NoError(r.t, err)
+	}
+
+	hash, err := w.Commit("update", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+	})
+	require.NoError(r.t, err)
+	return hash.String()
+}
+
+// Tag tags the current commit of the remote, creating an annotated tag when a
+// message is given.
+func (r *testRemote) Tag(name string, message string) {
+	r.t.Helper()
+
+	head, err := r.repo.Head()
+	require.NoError(r.t, err)
+
+	var opts *git.CreateTagOptions
+	if message != "" {
+		opts = &git.CreateTagOptions{
+			Tagger:  &object.Signature{Name: "test", Email: "test@example.com", When: time.Now()},
+			Message: message,
+		}
+	}
+	_, err = r.repo.CreateTag(name, head.Hash(), opts)
+	require.NoError(r.t, err)
+}
+
+func (r *testRemote) Options(path string) SyncOptions {
+	return SyncOptions{
+		Path:         path,
+		RefName:      plumbing.NewBranchReferenceName("main"),
+		PollInterval: time.Hour,
+		Auth:         AuthOptions{Repo: filepath.Join(r.Path, ".git")},
+	}
+}
+
+func TestForceSync(t *testing.T) {
+	remote := newTestRemote(t)
+	path := filepath.Join(t.TempDir(), "repo")
+	s := NewSyncer(remote.Options(path))
+
+	require.NoError(t, s.ForceSync())
+	content, err := os.ReadFile(filepath.Join(path, "README.md"))
+	require.NoError(t, err)
+	require.Equal(t, "initial", string(content))
+
+	hash := remote.Commit(map[string]string{"README.md": "changed"})
+	require.NoError(t, s.ForceSync())
+	content, err = os.ReadFile(filepath.Join(path, "README.md"))
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(content))
+	require.Equal(t, hash, s.Status().LatestHash)
+}
+
+func TestStatus(t *testing.T) {
+	remote := newTestRemote(t)
+	s := NewSyncer(remote.Options(filepath.Join(t.TempDir(), "repo")))
+	require.Equal(t, PhaseIdle, s.Status().Phase)
+
+	require.NoError(t, s.ForceSync())
+	status := s.Status()
+	require.Equal(t, PhaseIdle, status.Phase)
+	require.False(t, status.LastSuccess.IsZero())
+	require.Positive(t, status.LastSyncDuration)
+	require.NotNil(t, status.Commit)
+	require.Equal(t, status.LatestHash, status.Commit.Hash)
+	require.Equal(t, "test <test@example.com>", status.Commit.Author)
+	require.Equal(t, "update", status.Commit.Message)
+	require.False(t, status.Commit.Timestamp.IsZero())
+
+	s.Options.RefName = plumbing.NewBranchReferenceName("missing")
+	require.Error(t, s.ForceSync())
+	require.Error(t, s.ForceSync())
+	status = s.Status()
+	require.Equal(t, 2, status.ConsecutiveFailures)
+	require.Contains(t, status.LastError, "reference not found")
+	require.False(t, status.LastErrorTime.IsZero())
+
+	s.Options.RefName = plumbing.NewBranchReferenceName("main")
+	require.NoError(t, s.ForceSync())
+	require.Zero(t, s.Status().ConsecutiveFailures)
+	require.NotEmpty(t, s.Status().LastError)
+}
+
+func TestForceSyncJoin(t *testing.T) {
+	remote := newTestRemote(t)
+	s := NewSyncer(remote.Options(filepath.Join(t.TempDir(), "repo")))
+	require.NoError(t, s.ForceSync())
+
+	// Hold the only sync slot so the next sync waits before fetching.
+	s.limiter = make(chan struct{}, 1)
+	s.limiter <- struct{}{}
+
+	errs := make(chan error, 3)
+	go func() { errs <- s.ForceSync() }()
+	require.Eventually(t, func() bool {
+		return s.Status().InProgress
+	}, 5*time.Second, time.Millisecond)
+
+	for range 2 {
+		go func() { errs <- s.ForceSync() }()
+	}
+	require.Eventually(t, func() bool {
+		s.statusLock.Lock()
+		defer s.statusLock.Unlock()
+		return s.running.joined == 2
+	}, 5*time.Second, time.Millisecond)
+
+	status := s.Status()
+	require.Equal(t, PhaseWaiting, status.Phase)
+	require.False(t, status.SyncStarted.IsZero())
+
+	<-s.limiter
+	for range 3 {
+		require.NoError(t, <-errs)
+	}
+	require.False(t, s.Status().InProgress)
+	require.Equal(t, PhaseIdle, s.Status().Phase)
+	require.InDelta(t, 2, testutil.ToFloat64(syncAttempts.WithLabelValues(s.metricsName())), 0,
+		"the three calls share one sync")
+}
+
+func TestCancel(t *testing.T) {
+	remote := newTestRemote(t)
+	s := NewSyncer(remote.Options(filepath.Join(t.TempDir(), "repo")))
+	require.ErrorIs(t, s.Cancel(), ErrNoSyncInProgress)
+
+	// Hold the only sync slot so the sync waits until it is canceled.
+	s.limiter = make(chan struct{}, 1)
+	s.limiter <- struct{}{}
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.ForceSync() }()
+	require.Eventually(t, func() bool {
+		return s.Status().InProgress
+	}, 5*time.Second, time.Millisecond)
+
+	require.NoError(t, s.Cancel())
+	err := <-errs
+	require.ErrorIs(t, err, ErrSyncCanceled)
+	require.ErrorIs(t, err, context.Canceled)
+	require.False(t, s.Status().InProgress)
+
+	<-s.limiter
+	require.NoError(t, s.ForceSync())
+}
+
+func TestForceSyncContext(t *testing.T) {
+	remote := newTestRemote(t)
+	s := NewSyncer(remote.Options(filepath.Join(t.TempDir(), "repo")))
+	s.limiter = make(chan struct{}, 1)
+	s.limiter <- struct{}{}
+
+	// The sync is canceled once its only caller gives up.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.ForceSyncContext(ctx), context.DeadlineExceeded)
+	require.False(t, s.Status().InProgress)
+
+	// A caller giving up does not cancel a sync others still wait for.
+	errs := make(chan error, 1)
+	go func() { errs <- s.ForceSync() }()
+	require.Eventually(t, func() bool {
+		return s.Status().InProgress
+	}, 5*time.Second, time.Millisecond)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	require.ErrorIs(t, s.ForceSyncContext(ctx), context.Canceled)
+
+	<-s.limiter
+	require.NoError(t, <-errs)
+}
+
+func TestTimeouts(t *testing.T) {
+	remote := newTestRemote(t)
+	opts := remote.Options(filepath.Join(t.TempDir(), "repo"))
+	opts.Timeouts.Clone = time.Nanosecond
+	s := NewSyncer(opts)
+
+	err := s.ForceSync()
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Contains(t, err.Error(), "clone")
+	require.Equal(t, "timeout", errorClass(err))
+
+	s.Options.Timeouts.Clone = 0
+	require.NoError(t, s.ForceSync())
+}
+
+func TestShutdown(t *testing.T) {
+	remote := newTestRemote(t)
+	s := NewSyncer(remote.Options(filepath.Join(t.TempDir(), "repo")))
+	s.limiter = make(chan struct{}, 1)
+	s.limiter <- struct{}{}
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.ForceSync() }()
+	require.Eventually(t, func() bool {
+		return s.Status().InProgress
+	}, 5*time.Second, time.Millisecond)
+
+	// The sync in progress may finish.
+	time.AfterFunc(50*time.Millisecond, func() { <-s.limiter })
+	require.NoError(t, s.Shutdown(context.Background()))
+	require.NoError(t, <-errs)
+	require.ErrorIs(t, s.ForceSync(), ErrSyncerClosed)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	remote := newTestRemote(t)
+	s := NewSyncer(remote.Options(filepath.Join(t.TempDir(), "repo")))
+	s.limiter = make(chan struct{}, 1)
+	s.limiter <- struct{}{}
+	s.Start()
+
+	errs := make(chan error, 1)
+	go func() { errs <- s.ForceSync() }()
+	require.Eventually(t, func() bool {
+		return s.Status().InProgress
+	}, 5*time.Second, time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, s.Shutdown(ctx), context.DeadlineExceeded)
+	require.ErrorIs(t, <-errs, ErrSyncCanceled)
+	require.False(t, s.Status().InProgress)
+	require.True(t, s.Status().NextPoll.IsZero(), "polling stopped")
+}
+
+func TestDegraded(t *testing.T) {
+	remote := newTestRemote(t)
+	path := filepath.Join(t.TempDir(), "repo")
+	s := NewSyncer(remote.Options(path))
+	require.Equal(t, HealthUnavailable, s.Status().Health())
+
+	hash := remote.Commit(map[string]string{"README.md": "changed"})
+	require.NoError(t, s.ForceSync())
+	require.Equal(t, HealthOK, s.Status().Health())
+
+	// A new Syncer serves the existing worktree while the remote is gone.
+	require.NoError(t, os.RemoveAll(remote.Path))
+	s = NewSyncer(remote.Options(path))
+	require.Error(t, s.ForceSync())
+	status := s.Status()
+	require.True(t, status.Degraded)
+	require.Equal(t, HealthDegraded, status.Health())
+	require.Equal(t, hash, status.LatestHash)
+	content, err := os.ReadFile(filepath.Join(path, "README.md"))
+	require.NoError(t, err)
+	require.Equal(t, "changed", string(content))
+}